@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+)
+
+// sdkBuilder drives the construction of an SDK image step by step, the way
+// buildah builds a Dockerfile: a working container is created from a parent
+// image, a single instruction is run inside it, the result is committed as
+// an intermediate image, and that image becomes the parent of the next
+// step. This replaces running the whole of 'bootstrap.sh' as one opaque
+// container and committing a single final image.
+//
+// Each step's intermediate image is tagged with a content-addressable key
+// derived from its parent image, its own command and a digest of the SDK's
+// directory in the repo, so a step whose inputs haven't changed is reused
+// instead of rebuilt.
+type sdkBuilder struct {
+	Sdk       *sdk
+	ImageName string
+	NoCache   bool
+}
+
+func newSdkBuilder(s *sdk) *sdkBuilder {
+	return &sdkBuilder{
+		Sdk:       s,
+		ImageName: newImageRef(s.Name, "").Repository(),
+		NoCache:   *noCache || s.Bootstrap.No_cache,
+	}
+}
+
+// cacheKeyFor derives a content-addressable key for a build step from the ID
+// of its parent image and a descriptor covering everything else that
+// determines its output (a command, or a copy source's path and digest).
+func cacheKeyFor(parentImage string, descriptor string) (string, error) {
+	parentID, err := runtime.imageID(parentImage)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(parentID))
+	h.Write([]byte(descriptor))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// build runs every step of s.Bootstrap.Steps in order on top of baseImage
+// and returns the reference of the last intermediate image produced, which
+// is the caller's responsibility to tag as the final SDK image.
+func (b *sdkBuilder) build(baseImage string) (string, error) {
+	parent := baseImage
+	for i, step := range b.Sdk.Bootstrap.Steps {
+		Info.Printf("Running bootstrap step %d/%d: %s", i+1, len(b.Sdk.Bootstrap.Steps), step)
+
+		stepImage, err := b.runStep(i, step, parent)
+		if err != nil {
+			return "", fmt.Errorf("bootstrap step %d ('%s') failed: %s", i, step, err)
+		}
+		parent = stepImage
+	}
+	return parent, nil
+}
+
+// runStep executes a single step command in a working container created
+// from parentImage and commits the result under a cache key derived from
+// parentImage and the step's descriptor (see stepDescriptor), unless an
+// image already exists under that key.
+func (b *sdkBuilder) runStep(index int, command string, parentImage string) (string, error) {
+	descriptor, err := b.stepDescriptor(command)
+	if err != nil {
+		return "", fmt.Errorf("could not compute step descriptor: %s", err)
+	}
+
+	cacheKey, err := b.stepCacheKey(parentImage, descriptor)
+	if err != nil {
+		return "", fmt.Errorf("could not compute cache key: %s", err)
+	}
+	stepImage := fmt.Sprintf("%s:step-%s", b.ImageName, cacheKey[:16])
+
+	if !b.NoCache {
+		found, err := runtime.imageExists(stepImage)
+		if err == nil && found {
+			Debug.Printf("Cache hit for bootstrap step %d, reusing '%s'", index, stepImage)
+			return stepImage, nil
+		}
+	}
+
+	workContainer := fmt.Sprintf("%s_%s.bootstrap.step%d.working", b.Sdk.Product.Short_name, b.Sdk.Name, index)
+
+	// Best-effort: a previous interrupted build may have left this container around.
+	runtime.removeContainer(workContainer)
+
+	err = runtime.runBuildStep(parentImage, []string{"/bin/sh", "-c", command}, workContainer, nil, "", b.Sdk, nil, "bootstrap")
+	if err != nil {
+		return "", err
+	}
+
+	err = runtime.commitWithLabels(workContainer, stepImage, map[string]string{"cosmk.cache.key": cacheKey})
+	if err != nil {
+		return "", fmt.Errorf("could not commit step %d: %s", index, err)
+	}
+
+	err = runtime.removeContainer(workContainer)
+	if err != nil {
+		Debug.Printf("Could not remove working container '%s': %s", workContainer, err)
+	}
+
+	return stepImage, nil
+}
+
+// stepCacheKey derives a content-addressable key for a bootstrap step from
+// the ID of its parent image and its descriptor (its command plus a digest
+// of the files it may reference): the inputs that determine the step's
+// output.
+func (b *sdkBuilder) stepCacheKey(parentImage string, descriptor string) (string, error) {
+	return cacheKeyFor(parentImage, descriptor)
+}
+
+// stepDescriptor folds command together with a digest of the SDK's own
+// directory in the repo (bootstrap.sh and whatever files it reads, e.g.
+// overlays or patches it applies) so that editing any of them invalidates
+// the step's cache entry the same way recipeBuilder's 'copy' digest does,
+// instead of caching purely on the command string.
+func (b *sdkBuilder) stepDescriptor(command string) (string, error) {
+	sdkDir := path.Join(repoRootPath, "products", rootConfig.Product.Name, b.Sdk.Name)
+	digest, err := pathDigest(sdkDir)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s", command, digest), nil
+}
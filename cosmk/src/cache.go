@@ -0,0 +1,321 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Number of recipes downloaded concurrently from the CI.
+const cacheWorkerPoolSize = 4
+
+// gitlabJob is the subset of the GitLab v4 "jobs" API response we care about.
+type gitlabJob struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// gitlabCi is a minimal client for the parts of the GitLab v4 API needed to
+// walk a pipeline down to the per-recipe artifact archives, replacing the
+// former shell-out to 'toolkit/helpers/get-cache-from-ci.sh'.
+type gitlabCi struct {
+	client    *http.Client
+	url       string
+	projectID string
+	token     string
+}
+
+func newGitlabCi() *gitlabCi {
+	return &gitlabCi{
+		client:    &http.Client{},
+		url:       rootConfig.Ci.Url,
+		projectID: rootConfig.Ci.Project_id,
+		token:     rootConfig.Ci.Token,
+	}
+}
+
+func (g *gitlabCi) get(url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, values := range header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	if g.token != "" {
+		req.Header.Set("PRIVATE-TOKEN", g.token)
+	}
+	return g.client.Do(req)
+}
+
+func (g *gitlabCi) getJSON(url string, out interface{}) error {
+	resp, err := g.get(url, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET '%s' returned status '%s'", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// latestSuccessfulPipeline returns the ID of the most recent successful
+// pipeline for the configured project.
+func (g *gitlabCi) latestSuccessfulPipeline() (int, error) {
+	url := fmt.Sprintf("%s/api/v4/projects/%s/pipelines?scope=finished&status=success", g.url, g.projectID)
+	Debug.Printf("Requesting pipeline status from %s", url)
+
+	var pipelines []struct {
+		ID int `json:"id"`
+	}
+	err := g.getJSON(url, &pipelines)
+	if err != nil {
+		return 0, fmt.Errorf("could not list pipelines: %s", err)
+	}
+	if len(pipelines) == 0 {
+		return 0, fmt.Errorf("could not find the latest successful pipeline")
+	}
+
+	return pipelines[0].ID, nil
+}
+
+// jobs returns every job of the given pipeline.
+func (g *gitlabCi) jobs(pipelineID int) ([]gitlabJob, error) {
+	url := fmt.Sprintf("%s/api/v4/projects/%s/pipelines/%d/jobs", g.url, g.projectID, pipelineID)
+	Debug.Printf("Requesting jobs from %s", url)
+
+	var jobs []gitlabJob
+	err := g.getJSON(url, &jobs)
+	if err != nil {
+		return nil, fmt.Errorf("could not list jobs for pipeline %d: %s", pipelineID, err)
+	}
+	return jobs, nil
+}
+
+// downloadArtifacts streams the artifacts ZIP of the given job to destZip,
+// resuming a previous partial download (kept as destZip+".part") via a Range
+// request when possible. The GitLab artifacts endpoint doesn't hand out an
+// expected digest to compare against, so the sha256 computed here is only
+// recorded (logged and emitted) for traceability, not a correctness check;
+// a corrupt or truncated download is only caught downstream when the ZIP
+// fails to unpack.
+func (g *gitlabCi) downloadArtifacts(jobID int, destZip string) error {
+	url := fmt.Sprintf("%s/api/v4/projects/%s/jobs/%d/artifacts", g.url, g.projectID, jobID)
+	partPath := destZip + ".part"
+
+	var resumeFrom int64
+	if fi, err := os.Stat(partPath); err == nil {
+		resumeFrom = fi.Size()
+	}
+
+	header := http.Header{}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resumeFrom > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", resumeFrom))
+		flags = os.O_WRONLY | os.O_APPEND
+		Debug.Printf("Resuming download of job %d artifacts from byte %d", jobID, resumeFrom)
+	}
+
+	resp, err := g.get(url, header)
+	if err != nil {
+		return fmt.Errorf("could not download artifacts for job %d: %s", jobID, err)
+	}
+	defer resp.Body.Close()
+
+	if resumeFrom > 0 && resp.StatusCode == http.StatusOK {
+		// Server ignored our Range request: start the download over.
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	} else if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("downloading artifacts for job %d returned status '%s'", jobID, resp.Status)
+	}
+
+	out, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open '%s': %s", partPath, err)
+	}
+	emitEvent("artifact-download-start", map[string]interface{}{"job_id": jobID, "resume_from": resumeFrom})
+	written, err := io.Copy(out, resp.Body)
+	out.Close()
+	if err != nil {
+		return fmt.Errorf("could not write '%s': %s", partPath, err)
+	}
+
+	sum, err := sha256sum(partPath)
+	if err != nil {
+		return fmt.Errorf("could not checksum '%s': %s", partPath, err)
+	}
+	Debug.Printf("Downloaded job %d artifacts, sha256 %s", jobID, sum)
+	emitEvent("artifact-download-finish", map[string]interface{}{"job_id": jobID, "bytes_transferred": written, "sha256": sum})
+
+	return os.Rename(partPath, destZip)
+}
+
+func sha256sum(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// extractRecipeBinpkgs unpacks every entry of a job's artifacts ZIP under
+// destDir (cache/<product>/<version>/<recipe>/), so that the ZIP's 'binpkgs/'
+// tree lands in cache/<product>/<version>/<recipe>/binpkgs/.
+func extractRecipeBinpkgs(zipPath, destDir string) error {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return fmt.Errorf("could not open artifacts archive '%s': %s", zipPath, err)
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		name := path.Clean(f.Name)
+		if strings.HasPrefix(name, "..") || path.IsAbs(name) {
+			Debug.Printf("Skipping suspicious archive entry '%s'", f.Name)
+			continue
+		}
+
+		destPath := path.Join(destDir, name)
+		if f.FileInfo().IsDir() {
+			os.MkdirAll(destPath, 0755)
+			continue
+		}
+
+		os.MkdirAll(path.Dir(destPath), 0755)
+		src, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("could not read '%s' from archive: %s", f.Name, err)
+		}
+		dst, err := os.OpenFile(destPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			src.Close()
+			return fmt.Errorf("could not create '%s': %s", destPath, err)
+		}
+		_, err = io.Copy(dst, src)
+		src.Close()
+		dst.Close()
+		if err != nil {
+			return fmt.Errorf("could not extract '%s': %s", f.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// fetchRecipeCache downloads and unpacks the binpkgs artifact for a single
+// recipe's job, keeping the cache layout the container runtime expects.
+func fetchRecipeCache(g *gitlabCi, p *product, jobsByName map[string]gitlabJob, recipeName string) error {
+	job, ok := jobsByName[recipeName]
+	if !ok {
+		Debug.Printf("No CI job found for recipe '%s', skipping", recipeName)
+		return nil
+	}
+
+	destDir := path.Join(repoRootPath, "cache", p.Short_name, p.Version, recipeName)
+	os.MkdirAll(destDir, 0755)
+
+	zipPath := path.Join(destDir, "artifacts.zip")
+	Info.Printf("Downloading artifacts for recipe '%s' (job %d)", recipeName, job.ID)
+	err := g.downloadArtifacts(job.ID, zipPath)
+	if err != nil {
+		return err
+	}
+
+	err = extractRecipeBinpkgs(zipPath, destDir)
+	if err != nil {
+		return err
+	}
+	os.Remove(zipPath)
+
+	Info.Printf("Cached binary packages for recipe '%s'", recipeName)
+	return nil
+}
+
+// doCache walks the GitLab pipeline -> jobs -> artifacts chain for the
+// latest successful pipeline and populates cache/<product>/<version>/<recipe>/binpkgs/
+// for every recipe of the selected product, downloading concurrently with a
+// bounded worker pool.
+func doCache() {
+	err := os.Chdir(repoRootPath)
+	if err != nil {
+		Error.Fatalf("Could not chdir to '%s': %s", repoRootPath, err)
+	}
+
+	cachePath := path.Join(repoRootPath, "cache")
+	_, err = os.Stat(cachePath)
+	if err == nil {
+		Error.Fatalf("Remove the 'cache' folder before proceeding.")
+	} else if !os.IsNotExist(err) {
+		Error.Fatalf("Could not stat '%s': %s", cachePath, err)
+	}
+
+	g := newGitlabCi()
+
+	pipelineID, err := g.latestSuccessfulPipeline()
+	if err != nil {
+		Error.Fatalf("%s", err)
+	}
+	Debug.Printf("Retrieving binary packages from pipeline ID: %d", pipelineID)
+
+	jobs, err := g.jobs(pipelineID)
+	if err != nil {
+		Error.Fatalf("%s", err)
+	}
+	jobsByName := make(map[string]gitlabJob, len(jobs))
+	for _, j := range jobs {
+		jobsByName[j.Name] = j
+	}
+
+	p := parseProductConfig()
+
+	poolSize := cacheWorkerPoolSize
+	if len(p.Recipes) < poolSize {
+		poolSize = len(p.Recipes)
+	}
+
+	recipeCh := make(chan string)
+	errCh := make(chan error, len(p.Recipes))
+	var wg sync.WaitGroup
+
+	for i := 0; i < poolSize; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for recipeName := range recipeCh {
+				errCh <- fetchRecipeCache(g, p, jobsByName, recipeName)
+			}
+		}()
+	}
+
+	for _, recipeName := range p.Recipes {
+		recipeCh <- recipeName
+	}
+	close(recipeCh)
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		if err != nil {
+			Error.Fatalf("%s", err)
+		}
+	}
+}
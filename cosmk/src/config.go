@@ -27,6 +27,19 @@ type configCi struct {
 	Registry   string
 	Project_id string
 	Artifacts  string
+	Token      string
+	Auth       map[string]configCiAuth
+}
+
+// configCiAuth holds the push/pull credentials for a single registry,
+// keyed by registry host in the '[ci.auth]' section of config.toml, e.g.
+// '[ci.auth."registry.example.org"]'. Either 'Username'/'Password' or
+// 'Token_file' (whose content is used as the password) may be set.
+type configCiAuth struct {
+	Username     string
+	Password     string
+	Token_file   string
+	Insecure_tls bool
 }
 
 type configDevelopment struct {
@@ -58,16 +71,16 @@ func doInstrumentationFeatures() {
 		// Test if selected feature is enabled
 		for _, feat := range rootConfig.Development.Instrumentation {
 			if *instrumentationFeature == feat {
-				println("true")
+				printResult("instrumentation-features", "true")
 				os.Exit(0)
 			}
 		}
-		println("false")
+		printResult("instrumentation-features", "false")
 		os.Exit(1)
 	} else {
 		// List enabled instrumentation features
 		for _, feat := range rootConfig.Development.Instrumentation {
-			println(feat)
+			printResult("instrumentation-features", feat+"\n")
 		}
 	}
 }
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+)
+
+// dockerEngine is the fallback container backend used when podman is not
+// available on the host, talking to the Docker daemon through its official
+// Go client instead of shelling out to 'sudo docker'.
+type dockerEngine struct {
+	cli *client.Client
+	ctx context.Context
+}
+
+func newDockerEngine() (*dockerEngine, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("could not create docker client: %s", err)
+	}
+
+	ctx := context.Background()
+	_, err = cli.Ping(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach docker daemon: %s", err)
+	}
+
+	return &dockerEngine{cli: cli, ctx: ctx}, nil
+}
+
+func (d *dockerEngine) imageExists(image string) (bool, error) {
+	_, _, err := d.cli.ImageInspectWithRaw(d.ctx, image)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *dockerEngine) imageID(image string) (string, error) {
+	inspect, _, err := d.cli.ImageInspectWithRaw(d.ctx, image)
+	if err != nil {
+		return "", err
+	}
+	return inspect.ID, nil
+}
+
+func (d *dockerEngine) listImages() ([]imageSummary, error) {
+	list, err := d.cli.ImageList(d.ctx, types.ImageListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]imageSummary, len(list))
+	for i, img := range list {
+		summaries[i] = imageSummary{
+			ID:      img.ID,
+			Tags:    img.RepoTags,
+			Labels:  img.Labels,
+			Created: time.Unix(img.Created, 0),
+		}
+	}
+	return summaries, nil
+}
+
+func (d *dockerEngine) listContainers() ([]containerSummary, error) {
+	list, err := d.cli.ContainerList(d.ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]containerSummary, len(list))
+	for i, c := range list {
+		name := c.ID
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		summaries[i] = containerSummary{ID: c.ID, Name: name, Created: time.Unix(c.Created, 0)}
+	}
+	return summaries, nil
+}
+
+func (d *dockerEngine) removeImage(image string) error {
+	_, err := d.cli.ImageRemove(d.ctx, image, types.ImageRemoveOptions{Force: true})
+	return err
+}
+
+func (d *dockerEngine) pull(ref string) error {
+	reader, err := d.cli.ImagePull(d.ctx, ref, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(os.Stdout, reader)
+	return err
+}
+
+// registryAuthHeader base64-encodes the credentials the Docker API expects
+// in the 'X-Registry-Auth' header. The Docker client has no per-call option
+// to skip TLS verification, so insecure registries are not supported here.
+func registryAuthHeader(username string, password string) (string, error) {
+	if username == "" && password == "" {
+		return "", nil
+	}
+	data, err := json.Marshal(types.AuthConfig{Username: username, Password: password})
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+func (d *dockerEngine) pullWithAuth(ref string, username string, password string) error {
+	authHeader, err := registryAuthHeader(username, password)
+	if err != nil {
+		return err
+	}
+	reader, err := d.cli.ImagePull(d.ctx, ref, types.ImagePullOptions{RegistryAuth: authHeader})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(os.Stdout, reader)
+	return err
+}
+
+func (d *dockerEngine) pushWithAuth(ref string, username string, password string) error {
+	authHeader, err := registryAuthHeader(username, password)
+	if err != nil {
+		return err
+	}
+	reader, err := d.cli.ImagePush(d.ctx, ref, types.ImagePushOptions{RegistryAuth: authHeader})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(os.Stdout, reader)
+	return err
+}
+
+func (d *dockerEngine) importRootfs(rootfsPath string, image string) error {
+	f, err := os.Open(rootfsPath)
+	if err != nil {
+		return fmt.Errorf("could not open rootfs '%s': %s", rootfsPath, err)
+	}
+	defer f.Close()
+
+	resp, err := d.cli.ImageImport(d.ctx, types.ImageImportSource{Source: f, SourceName: "-"}, image, types.ImageImportOptions{})
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	_, err = io.Copy(io.Discard, resp)
+	return err
+}
+
+// createContainer creates (but does not start) a container from image,
+// for instructions like 'copy' that only need a filesystem to write into.
+func (d *dockerEngine) createContainer(image string, name string) error {
+	_, err := d.cli.ContainerCreate(d.ctx, &container.Config{Image: image}, nil, nil, nil, name)
+	return err
+}
+
+// copyToContainer extracts the archive tar stream into destDir inside the
+// (stopped) container 'name'.
+func (d *dockerEngine) copyToContainer(name string, destDir string, archive io.Reader) error {
+	return d.cli.CopyToContainer(d.ctx, name, destDir, archive, types.CopyToContainerOptions{})
+}
+
+func (d *dockerEngine) removeContainer(name string) error {
+	err := d.cli.ContainerRemove(d.ctx, name, types.ContainerRemoveOptions{Force: true})
+	if err != nil && !client.IsErrNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *dockerEngine) tag(existingImage string, targetImage string) error {
+	return d.cli.ImageTag(d.ctx, existingImage, targetImage)
+}
+
+func (d *dockerEngine) commit(name string, image string) error {
+	repo, tag := splitImageTag(image)
+	_, err := d.cli.ContainerCommit(d.ctx, name, types.ContainerCommitOptions{
+		Reference: fmt.Sprintf("%s:%s", repo, tag),
+	})
+	return err
+}
+
+func (d *dockerEngine) commitWithLabels(name string, image string, changes []string) error {
+	repo, tag := splitImageTag(image)
+	_, err := d.cli.ContainerCommit(d.ctx, name, types.ContainerCommitOptions{
+		Reference: fmt.Sprintf("%s:%s", repo, tag),
+		Changes:   changes,
+	})
+	return err
+}
+
+func (d *dockerEngine) run(spec *containerSpec) error {
+	config := &container.Config{
+		Image:        spec.Image,
+		Cmd:          spec.Command,
+		WorkingDir:   spec.Workdir,
+		Hostname:     spec.Hostname,
+		Tty:          spec.Interactive,
+		OpenStdin:    spec.Interactive,
+		AttachStdin:  spec.Interactive,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	for k, v := range spec.Env {
+		config.Env = append(config.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	hostConfig := &container.HostConfig{
+		CapAdd:      spec.CapAdd,
+		AutoRemove:  spec.Remove,
+		SecurityOpt: []string{"label=disable"},
+	}
+	if !spec.Network {
+		hostConfig.NetworkMode = "none"
+	}
+	for _, m := range spec.Mounts {
+		if m.Kind == "tmpfs" {
+			if hostConfig.Tmpfs == nil {
+				hostConfig.Tmpfs = map[string]string{}
+			}
+			hostConfig.Tmpfs[m.Dest] = m.Options
+			continue
+		}
+		hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   m.Source,
+			Target:   m.Dest,
+			ReadOnly: m.Options == "ro",
+		})
+	}
+
+	created, err := d.cli.ContainerCreate(d.ctx, config, hostConfig, nil, nil, spec.Name)
+	if err != nil {
+		return fmt.Errorf("could not create container '%s': %s", spec.Name, err)
+	}
+
+	attach, err := d.cli.ContainerAttach(d.ctx, created.ID, types.ContainerAttachOptions{
+		Stream: true, Stdin: true, Stdout: true, Stderr: true,
+	})
+	if err != nil {
+		return fmt.Errorf("could not attach to container '%s': %s", spec.Name, err)
+	}
+	defer attach.Close()
+	go io.Copy(attach.Conn, os.Stdin)
+	go io.Copy(os.Stdout, attach.Reader)
+
+	err = d.cli.ContainerStart(d.ctx, created.ID, types.ContainerStartOptions{})
+	if err != nil {
+		return fmt.Errorf("could not start container '%s': %s", spec.Name, err)
+	}
+
+	statusCh, errCh := d.cli.ContainerWait(d.ctx, created.ID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return fmt.Errorf("could not wait for container '%s': %s", spec.Name, err)
+		}
+	case status := <-statusCh:
+		emitEvent("exec-exit", map[string]interface{}{"container": spec.Name, "exit_code": status.StatusCode})
+		if status.StatusCode != 0 {
+			return fmt.Errorf("container '%s' exited with code %d", spec.Name, status.StatusCode)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// imageRef is a parsed, runtime-agnostic image reference for an SDK or
+// recipe image: an optional registry, the product it belongs to, its name
+// and its tag. It centralizes the 'fmt.Sprintf("%s/%s", ...)' assembly that
+// used to be scattered across sdk.go and recipe.go.
+type imageRef struct {
+	Registry string
+	Product  string
+	Name     string
+	Tag      string
+}
+
+// newImageRef builds an imageRef for an image of the currently configured
+// product.
+func newImageRef(name string, tag string) imageRef {
+	return imageRef{Product: rootConfig.Product.Name, Name: name, Tag: tag}
+}
+
+// parseImageRef parses a full image reference of the form
+// '[registry/]product/name[:tag]' into its components.
+func parseImageRef(ref string) (imageRef, error) {
+	repository, tag := parseRepositoryTag(ref)
+
+	parts := strings.Split(repository, "/")
+	switch len(parts) {
+	case 2:
+		return imageRef{Product: parts[0], Name: parts[1], Tag: tag}, nil
+	case 3:
+		return imageRef{Registry: parts[0], Product: parts[1], Name: parts[2], Tag: tag}, nil
+	default:
+		return imageRef{}, fmt.Errorf("could not parse image reference '%s'", ref)
+	}
+}
+
+// parseRepositoryTag splits ref into its repository and tag the way
+// dotcloud/docker/utils.ParseRepositoryTag always has: only the last ':' is
+// considered a tag separator, and it is ignored when what follows it looks
+// like a registry port (i.e. contains a '/') rather than a tag.
+func parseRepositoryTag(ref string) (repository string, tag string) {
+	idx := strings.LastIndex(ref, ":")
+	if idx < 0 {
+		return ref, ""
+	}
+	if strings.Contains(ref[idx+1:], "/") {
+		return ref, ""
+	}
+	return ref[:idx], ref[idx+1:]
+}
+
+// Repository returns the reference without its tag, e.g. 'clipos/core'.
+func (r imageRef) Repository() string {
+	return fmt.Sprintf("%s/%s", r.Product, r.Name)
+}
+
+// RepositoryTag returns the unprefixed 'product/name:tag' form used
+// wherever a plain (not registry- or localhost-qualified) reference is
+// expected.
+func (r imageRef) RepositoryTag() string {
+	return fmt.Sprintf("%s:%s", r.Repository(), r.Tag)
+}
+
+// String returns r.Remote(r.Registry) if a registry is set, and
+// r.RepositoryTag() otherwise.
+func (r imageRef) String() string {
+	if r.Registry != "" {
+		return r.Remote(r.Registry)
+	}
+	return r.RepositoryTag()
+}
+
+// Local returns the reference as resolved from local container storage,
+// e.g. 'localhost/clipos/core:1.0'.
+func (r imageRef) Local() string {
+	return fmt.Sprintf("localhost/%s", r.RepositoryTag())
+}
+
+// Remote returns the reference as pushed to or pulled from registry, e.g.
+// 'registry.example.org/clipos/core:1.0'.
+func (r imageRef) Remote(registry string) string {
+	return fmt.Sprintf("%s/%s", registry, r.RepositoryTag())
+}
+
+// resolveName returns arg unchanged when it already names one of known
+// (sdk or recipe names), and otherwise tries to expand it as a short image
+// ID or partial name via expandID, so that commands taking a recipe/SDK
+// argument also accept e.g. a truncated image ID. Falls back to arg on
+// any resolution failure, leaving the caller to report the "not found"
+// error it already knows how to produce.
+func resolveName(arg string, known []string) string {
+	for _, name := range known {
+		if name == arg {
+			return arg
+		}
+	}
+
+	resolved, err := expandID(arg)
+	if err != nil {
+		return arg
+	}
+	ref, err := parseImageRef(resolved)
+	if err != nil {
+		return arg
+	}
+	return ref.Name
+}
+
+// expandID resolves a short (12-char prefix) image ID or a partial
+// recipe/SDK name (matched against '<product>/<name>' or just '<name>') to
+// the single stored image it designates, erroring if none or more than one
+// image match. An image matched by ID is returned as its first tag when it
+// has one, and as its full ID otherwise.
+func expandID(id string) (string, error) {
+	summaries, err := runtime.listImages()
+	if err != nil {
+		return "", fmt.Errorf("could not list images: %s", err)
+	}
+
+	var matches []string
+	for _, img := range summaries {
+		if id != "" && strings.HasPrefix(strings.TrimPrefix(img.ID, "sha256:"), id) {
+			if len(img.Tags) > 0 {
+				matches = append(matches, img.Tags[0])
+			} else {
+				matches = append(matches, img.ID)
+			}
+			continue
+		}
+		for _, tag := range img.Tags {
+			ref, err := parseImageRef(tag)
+			if err != nil {
+				continue
+			}
+			if ref.Name == id || ref.Repository() == id {
+				matches = append(matches, tag)
+				break
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no image found matching '%s'", id)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("'%s' is ambiguous, matches %d images: %s", id, len(matches), strings.Join(matches, ", "))
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// lintIssue is a single finding reported by one of the lint analyzers.
+type lintIssue struct {
+	File    string `json:"file"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+	Fixable bool   `json:"fixable"`
+	fixFunc func() error
+}
+
+// lintContext carries the parsed product/recipe/sdk trees so analyzers don't
+// each have to re-read and re-decode the same TOML files.
+type lintContext struct {
+	product     *product
+	productPath string
+	recipes     map[string]recipeToml
+	sdks        map[string]sdkToml
+}
+
+// doLint runs every analyzer over the selected product tree, prints the
+// findings and, with --fix, applies the ones that know how to fix
+// themselves. It returns the process exit code (non-zero if issues remain).
+func doLint(fix bool, jsonOutput bool) int {
+	ctx, err := loadLintContext()
+	if err != nil {
+		Error.Fatalf("Could not load configuration for linting: %s", err)
+	}
+
+	analyzers := []func(*lintContext) []lintIssue{
+		lintUnknownKeys,
+		lintMissingReferences,
+		lintUnusedWritableAssets,
+		lintUnusedInstrumentationFeatures,
+		lintNetworkEnabled,
+		lintDanglingEnvironment,
+		lintShellScriptHygiene,
+	}
+
+	var issues []lintIssue
+	for _, analyzer := range analyzers {
+		issues = append(issues, analyzer(ctx)...)
+	}
+
+	if fix {
+		var remaining []lintIssue
+		for _, issue := range issues {
+			if issue.Fixable && issue.fixFunc != nil {
+				if err := issue.fixFunc(); err != nil {
+					Error.Printf("Could not fix '%s' in '%s': %s", issue.Rule, issue.File, err)
+					remaining = append(remaining, issue)
+				} else {
+					Info.Printf("Fixed '%s' in '%s'", issue.Rule, issue.File)
+				}
+				continue
+			}
+			remaining = append(remaining, issue)
+		}
+		issues = remaining
+	}
+
+	if jsonOutput {
+		printLintIssuesJSON(issues)
+	} else {
+		printLintIssuesText(issues)
+	}
+
+	if len(issues) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func printLintIssuesText(issues []lintIssue) {
+	for _, issue := range issues {
+		fixable := ""
+		if issue.Fixable {
+			fixable = " (fixable with --fix)"
+		}
+		fmt.Fprintf(os.Stdout, "%s: [%s] %s%s\n", issue.File, issue.Rule, issue.Message, fixable)
+	}
+	if len(issues) == 0 {
+		fmt.Fprintln(os.Stdout, "No issues found.")
+	}
+}
+
+func printLintIssuesJSON(issues []lintIssue) {
+	// lintIssue.fixFunc is not serializable; encoding/json skips it because
+	// it is unexported.
+	if issues == nil {
+		issues = []lintIssue{}
+	}
+	out, err := json.MarshalIndent(issues, "", "  ")
+	if err != nil {
+		Error.Fatalf("Could not marshal lint findings: %s", err)
+	}
+	fmt.Fprintln(os.Stdout, string(out))
+}
+
+func loadLintContext() (*lintContext, error) {
+	productPath := path.Join(repoRootPath, "products", rootConfig.Product.Name)
+	p := parseProductConfig()
+
+	ctx := &lintContext{
+		product:     p,
+		productPath: productPath,
+		recipes:     make(map[string]recipeToml),
+		sdks:        make(map[string]sdkToml),
+	}
+
+	entries, err := ioutil.ReadDir(productPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not list '%s': %s", productPath, err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		recipeTomlPath := path.Join(productPath, entry.Name(), "recipe.toml")
+		if content, err := ioutil.ReadFile(recipeTomlPath); err == nil {
+			var r recipeToml
+			if _, err := toml.Decode(string(content), &r); err == nil {
+				ctx.recipes[entry.Name()] = r
+			}
+		}
+
+		sdkTomlPath := path.Join(productPath, entry.Name(), "sdk.toml")
+		if content, err := ioutil.ReadFile(sdkTomlPath); err == nil {
+			var s sdkToml
+			if _, err := toml.Decode(string(content), &s); err == nil {
+				ctx.sdks[entry.Name()] = s
+			}
+		}
+	}
+
+	return ctx, nil
+}
+
+// lintUnknownKeys flags TOML keys present in config.toml, product.toml,
+// recipe.toml and sdk.toml files that are not mapped to any known struct
+// field, which usually means a typo that was silently ignored.
+func lintUnknownKeys(ctx *lintContext) []lintIssue {
+	var issues []lintIssue
+
+	check := func(file string, v interface{}) {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return
+		}
+		meta, err := toml.Decode(string(content), v)
+		if err != nil {
+			issues = append(issues, lintIssue{File: file, Rule: "unknown-keys", Message: fmt.Sprintf("could not parse: %s", err)})
+			return
+		}
+		for _, key := range meta.Undecoded() {
+			issues = append(issues, lintIssue{
+				File:    file,
+				Rule:    "unknown-keys",
+				Message: fmt.Sprintf("unknown key '%s'", key),
+			})
+		}
+	}
+
+	check(path.Join(repoRootPath, "config.toml"), &config{})
+	check(path.Join(ctx.productPath, "product.toml"), &product{})
+	for name := range ctx.recipes {
+		check(path.Join(ctx.productPath, name, "recipe.toml"), &recipeToml{})
+	}
+	for name := range ctx.sdks {
+		check(path.Join(ctx.productPath, name, "sdk.toml"), &sdkToml{})
+	}
+
+	return issues
+}
+
+// lintMissingReferences flags recipes in product.toml with no matching
+// recipe.toml, and recipes whose 'sdk' does not resolve to an sdk.toml.
+func lintMissingReferences(ctx *lintContext) []lintIssue {
+	var issues []lintIssue
+
+	for _, recipeName := range ctx.product.Recipes {
+		if _, ok := ctx.recipes[recipeName]; !ok {
+			issues = append(issues, lintIssue{
+				File:    path.Join(ctx.productPath, "product.toml"),
+				Rule:    "missing-reference",
+				Message: fmt.Sprintf("recipe '%s' listed but 'recipe.toml' not found", recipeName),
+			})
+		}
+	}
+
+	for name, r := range ctx.recipes {
+		sdkName := strings.TrimPrefix(r.Sdk, fmt.Sprintf("%s/", ctx.product.Short_name))
+		if _, ok := ctx.sdks[sdkName]; !ok {
+			issues = append(issues, lintIssue{
+				File:    path.Join(ctx.productPath, name, "recipe.toml"),
+				Rule:    "missing-reference",
+				Message: fmt.Sprintf("sdk '%s' not found", r.Sdk),
+			})
+		}
+	}
+
+	return issues
+}
+
+// lintUnusedWritableAssets flags 'writable_assets' entries in an sdk.toml
+// that do not correspond to an existing directory under assets/.
+func lintUnusedWritableAssets(ctx *lintContext) []lintIssue {
+	var issues []lintIssue
+
+	for name, s := range ctx.sdks {
+		for _, dir := range s.Build.Writable_assets {
+			assetPath := path.Join(repoRootPath, "assets", dir)
+			if _, err := os.Stat(assetPath); os.IsNotExist(err) {
+				issues = append(issues, lintIssue{
+					File:    path.Join(ctx.productPath, name, "sdk.toml"),
+					Rule:    "unused-writable-asset",
+					Message: fmt.Sprintf("writable_assets entry '%s' does not exist under 'assets/'", dir),
+				})
+			}
+		}
+	}
+
+	return issues
+}
+
+// lintUnusedInstrumentationFeatures flags instrumentation feature names set
+// in config.toml that no recipe's environment ever tests for.
+func lintUnusedInstrumentationFeatures(ctx *lintContext) []lintIssue {
+	var issues []lintIssue
+
+	for _, feature := range rootConfig.Development.Instrumentation {
+		used := false
+		for _, r := range ctx.recipes {
+			for _, v := range r.Environment {
+				if strings.Contains(v, feature) {
+					used = true
+				}
+			}
+		}
+		if !used {
+			issues = append(issues, lintIssue{
+				File:    path.Join(repoRootPath, "config.toml"),
+				Rule:    "unused-instrumentation-feature",
+				Message: fmt.Sprintf("instrumentation feature '%s' is enabled but not referenced by any recipe", feature),
+			})
+		}
+	}
+
+	return issues
+}
+
+// lintNetworkEnabled flags development.network being left enabled, which
+// should only ever be a deliberate, temporary choice on a development tree.
+func lintNetworkEnabled(ctx *lintContext) []lintIssue {
+	if rootConfig.Development.Network == "yes" {
+		return []lintIssue{{
+			File:    path.Join(repoRootPath, "config.toml"),
+			Rule:    "network-enabled",
+			Message: "development.network is set to 'yes'; make sure this is not committed for a release build",
+		}}
+	}
+	return nil
+}
+
+// lintDanglingEnvironment flags recipe 'Environment' entries with an empty
+// value, which usually means the variable was meant to be filled in but
+// never was.
+func lintDanglingEnvironment(ctx *lintContext) []lintIssue {
+	var issues []lintIssue
+
+	for name, r := range ctx.recipes {
+		for k, v := range r.Environment {
+			if v == "" {
+				issues = append(issues, lintIssue{
+					File:    path.Join(ctx.productPath, name, "recipe.toml"),
+					Rule:    "dangling-environment",
+					Message: fmt.Sprintf("environment entry '%s' has an empty value", k),
+				})
+			}
+		}
+	}
+
+	return issues
+}
+
+// lintShellScriptHygiene flags '*.sh' action scripts under the product tree
+// that are missing a shebang line or are not executable.
+func lintShellScriptHygiene(ctx *lintContext) []lintIssue {
+	var issues []lintIssue
+
+	for name := range ctx.recipes {
+		recipeDir := path.Join(ctx.productPath, name)
+		entries, err := ioutil.ReadDir(recipeDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sh") {
+				continue
+			}
+			scriptPath := path.Join(recipeDir, entry.Name())
+
+			if entry.Mode()&0111 == 0 {
+				issues = append(issues, lintIssue{
+					File:    scriptPath,
+					Rule:    "script-not-executable",
+					Message: "script is not executable",
+					Fixable: true,
+					fixFunc: func(p string, mode os.FileMode) func() error {
+						return func() error { return os.Chmod(p, mode|0755) }
+					}(scriptPath, entry.Mode()),
+				})
+			}
+
+			content, err := ioutil.ReadFile(scriptPath)
+			if err == nil && !strings.HasPrefix(string(content), "#!") {
+				issues = append(issues, lintIssue{
+					File:    scriptPath,
+					Rule:    "script-missing-shebang",
+					Message: "script has no shebang line",
+				})
+			}
+		}
+	}
+
+	return issues
+}
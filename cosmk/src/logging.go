@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// Logging helpers. Debug/Info/Error keep their historical *log.Logger type
+// so every call site in the codebase (Printf/Println/Fatalf...) is
+// unaffected; what changes with --log-format is the io.Writer they write
+// into, which either keeps the legacy "[*]"/"[!]" prefixed text or wraps
+// every line into an NDJSON record.
+var (
+	Debug *log.Logger
+	Info  *log.Logger
+	Error *log.Logger
+)
+
+// outputFormat controls how command *results* (product-name, container,
+// instrumentation-features, cache/build progress...) are rendered, as
+// opposed to logFormat below which only controls Debug/Info/Error. Set from
+// the global --output flag.
+var outputFormat = "text"
+
+func initLogging(debug *bool, logFormat string) {
+	if logFormat == "json" {
+		Debug = log.New(ndjsonWriter{level: "debug", enabled: *debug}, "", 0)
+		Info = log.New(ndjsonWriter{level: "info", enabled: true}, "", 0)
+		Error = log.New(ndjsonWriter{level: "error", enabled: true, stderr: true}, "", 0)
+		return
+	}
+
+	if *debug {
+		Debug = log.New(os.Stdout, "DEBUG:   ", log.Ldate|log.Ltime|log.Lshortfile)
+		Info = log.New(os.Stdout, "INFO:    ", log.Ldate|log.Ltime|log.Lshortfile)
+		Error = log.New(os.Stderr, "ERROR:   ", log.Ldate|log.Ltime|log.Lshortfile)
+		Debug.Println("Log level set to debug")
+	} else {
+		Debug = log.New(ioutil.Discard, "", 0)
+		Info = log.New(os.Stdout, "[*] ", 0)
+		Error = log.New(os.Stdout, "[!] ", 0)
+	}
+}
+
+// ndjsonWriter turns every line a *log.Logger writes into one NDJSON record
+// {"time", "level", "message"} on stdout (or stderr for the error level).
+type ndjsonWriter struct {
+	level   string
+	enabled bool
+	stderr  bool
+}
+
+func (w ndjsonWriter) Write(p []byte) (int, error) {
+	if !w.enabled {
+		return len(p), nil
+	}
+
+	record := logRecord{
+		Time:    time.Now().Format(time.RFC3339),
+		Level:   w.level,
+		Message: string(p[:len(p)-trailingNewlines(p)]),
+	}
+
+	out := os.Stdout
+	if w.stderr {
+		out = os.Stderr
+	}
+	return len(p), writeNDJSON(out, record)
+}
+
+func trailingNewlines(p []byte) int {
+	n := 0
+	for n < len(p) && p[len(p)-1-n] == '\n' {
+		n++
+	}
+	return n
+}
+
+// logRecord is a single structured log line.
+type logRecord struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+func writeNDJSON(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// resultRecord is emitted on stdout for a command's primary output
+// (product-name, container, ...) when --output=json is set.
+type resultRecord struct {
+	Command string `json:"command"`
+	Value   string `json:"value"`
+}
+
+// printResult writes a command's output either as plain text (the
+// historical behaviour, no trailing newline) or, with --output=json, as a
+// single {"command", "value"} NDJSON record.
+func printResult(command string, value string) {
+	if outputFormat == "json" {
+		writeNDJSON(os.Stdout, resultRecord{Command: command, Value: value})
+		return
+	}
+	fmt.Fprint(os.Stdout, value)
+}
+
+// event is a structured progress record emitted by long running subsystems
+// (the container runtime, the cache downloader...) so CI wrappers can drive
+// cosmk without scraping human-readable log lines. It is only emitted when
+// --output=json is set; otherwise it is folded into a Debug line.
+type event struct {
+	Time   string                 `json:"time"`
+	Type   string                 `json:"type"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+func emitEvent(kind string, fields map[string]interface{}) {
+	if outputFormat != "json" {
+		Debug.Printf("%s: %v", kind, fields)
+		return
+	}
+	writeNDJSON(os.Stdout, event{
+		Time:   time.Now().Format(time.RFC3339),
+		Type:   kind,
+		Fields: fields,
+	})
+}
@@ -9,7 +9,11 @@ import (
 )
 
 var (
-	debug = kingpin.Flag("debug", "Enable debug output.").Short('d').Bool()
+	debug     = kingpin.Flag("debug", "Enable debug output.").Short('d').Bool()
+	logFormat = kingpin.Flag("log-format", "Format of Debug/Info/Error log output.").Default("text").Enum("text", "json")
+	output    = kingpin.Flag("output", "Format of a command's result output (product-name, container, instrumentation-features, cache, build...).").Default("text").Enum("text", "json")
+	noCache   = kingpin.Flag("no-cache", "Disable the bootstrap step and recipe action caches and rebuild every SDK bootstrap step and recipe action from scratch.").Bool()
+	publish   = kingpin.Flag("publish", "Push built SDK images to the CI registry after a successful bootstrap (or set COSMK_PUBLISH=1).").Bool()
 
 	repoRootPathCmd = kingpin.Command("repo-root-path", "Output on stdout the repo root absolute path.")
 
@@ -22,14 +26,20 @@ var (
 
 	cacheCmd = kingpin.Command("cache", "Download pre-built binary packages from the CI.")
 
+	lintCmd  = kingpin.Command("lint", "Run static analysis checks over the product, SDK and recipe configurations.")
+	lintFix  = lintCmd.Flag("fix", "Automatically fix issues that support it.").Bool()
+	lintJSON = lintCmd.Flag("json", "Emit findings as a JSON array instead of text.").Bool()
+
 	docCmd      = kingpin.Command("doc", "")
 	docBuildCmd = docCmd.Command("build", "Build the documentation.")
 	docOpenCmd  = docCmd.Command("open", "Open the documentation in the default browser, building it if necessary.")
 	docCleanCmd = docCmd.Command("clean", "Remove documentation build folder.")
 
-	allCmd = kingpin.Command("all", "Run all steps required to build a product.")
+	allCmd  = kingpin.Command("all", "Run all steps required to build a product.")
+	allJobs = allCmd.Flag("jobs", "Number of recipes to build concurrently.").Short('j').Default("1").Int()
 
-	reconfCmd = kingpin.Command("reconf", "Build a product but skip 'build' & 'image' steps (iterative rebuild/reconfiguration).")
+	reconfCmd  = kingpin.Command("reconf", "Build a product but skip 'build' & 'image' steps (iterative rebuild/reconfiguration).")
+	reconfJobs = reconfCmd.Flag("jobs", "Number of recipes to reconfigure concurrently.").Short('j').Default("1").Int()
 
 	bootstrapCmd = kingpin.Command("bootstrap", "Bootstrap a SDK recipe.")
 	bootstrapSdk = bootstrapCmd.Arg("recipe", "recipe to use.").HintAction(listSdks).Required().String()
@@ -37,6 +47,17 @@ var (
 	containerCmd = kingpin.Command("container", "Output on stdout the container name and tag for the given Sdk recipe.")
 	containerSdk = containerCmd.Arg("recipe", "Sdk to use.").HintAction(listSdks).Required().String()
 
+	sdkCmd     = kingpin.Command("sdk", "Interact with SDK images directly.")
+	sdkPushCmd = sdkCmd.Command("push", "Push a SDK's final and bootstrap images to the CI registry.")
+	sdkPushSdk = sdkPushCmd.Arg("recipe", "Sdk to use.").HintAction(listSdks).Required().String()
+	sdkPullCmd = sdkCmd.Command("pull", "Pull a SDK's final image from the CI registry into local storage.")
+	sdkPullSdk = sdkPullCmd.Arg("recipe", "Sdk to use.").HintAction(listSdks).Required().String()
+
+	pruneCmd    = kingpin.Command("prune", "Remove leftover working containers and stale intermediate images.")
+	pruneAll    = pruneCmd.Flag("all", "Also remove dangling cache layers left by the build caches.").Bool()
+	pruneDryRun = pruneCmd.Flag("dry-run", "Report what would be removed without removing it.").Bool()
+	pruneUntil  = pruneCmd.Flag("filter", "Only consider resources older than 'until=<duration>', e.g. 'until=24h'.").String()
+
 	runCmd     = kingpin.Command("run", "Start a shell in the SDK set for a recipe.")
 	runRecipe  = runCmd.Arg("recipe", "SDK or recipe to use.").HintAction(listAll).Required().String()
 	runCmdArgs = runCmd.Arg("command", "Command with arguments to run inside the SDK.").Strings()
@@ -79,20 +100,21 @@ func main() {
 	command := kingpin.Parse()
 
 	// Setup logging now that we know if we are running in debug mode or not
-	initLogging(debug)
+	outputFormat = *output
+	initLogging(debug, *logFormat)
 
 	switch command {
 	case "repo-root-path":
-		fmt.Fprintf(os.Stdout, repoRootPath)
+		printResult("repo-root-path", repoRootPath)
 
 	case "product-name":
-		fmt.Fprintf(os.Stdout, parseProductConfig().Short_name)
+		printResult("product-name", parseProductConfig().Short_name)
 
 	case "product-version":
-		fmt.Fprintf(os.Stdout, parseProductConfig().Version)
+		printResult("product-version", parseProductConfig().Version)
 
 	case "ci-registry":
-		fmt.Fprintf(os.Stdout, rootConfig.Ci.Registry)
+		printResult("ci-registry", rootConfig.Ci.Registry)
 
 	case "instrumentation-features":
 		doInstrumentationFeatures()
@@ -100,6 +122,9 @@ func main() {
 	case "cache":
 		doCache()
 
+	case "lint":
+		os.Exit(doLint(*lintFix, *lintJSON))
+
 	case docBuildCmd.FullCommand():
 		doBuildDoc()
 	case docOpenCmd.FullCommand():
@@ -109,21 +134,21 @@ func main() {
 
 	case "all":
 		findContainerRuntime()
-		err := parseProductConfig().do()
+		err := parseProductConfig().do(*allJobs)
 		if err != nil {
 			Error.Fatalf("Error: %s", err)
 		}
 
 	case "reconf":
 		findContainerRuntime()
-		err := parseProductConfig().reconfigure()
+		err := parseProductConfig().reconfigure(*reconfJobs)
 		if err != nil {
 			Error.Fatalf("Error: %s", err)
 		}
 
 	case "bootstrap":
 		findContainerRuntime()
-		s := parseSdkConfig(*bootstrapSdk)
+		s := parseSdkConfig(resolveName(*bootstrapSdk, listSdks()))
 		err := s.bootstrap()
 		if err != nil {
 			Error.Fatalf("Error: %s", err)
@@ -131,8 +156,46 @@ func main() {
 
 	case "container":
 		findContainerRuntime()
-		s := parseSdkConfig(*containerSdk)
-		fmt.Fprintf(os.Stdout, "%s/%s:%s", rootConfig.Product.Name, s.Name, s.Tag)
+		s := parseSdkConfig(resolveName(*containerSdk, listSdks()))
+		printResult("container", newImageRef(s.Name, s.Tag).RepositoryTag())
+
+	case sdkPushCmd.FullCommand():
+		findContainerRuntime()
+		s := parseSdkConfig(resolveName(*sdkPushSdk, listSdks()))
+		err := s.push()
+		if err != nil {
+			Error.Fatalf("Error: %s", err)
+		}
+
+	case sdkPullCmd.FullCommand():
+		findContainerRuntime()
+		s := parseSdkConfig(resolveName(*sdkPullSdk, listSdks()))
+		err := s.pull()
+		if err != nil {
+			Error.Fatalf("Error: %s", err)
+		}
+
+	case pruneCmd.FullCommand():
+		findContainerRuntime()
+		until, err := parsePruneFilter(*pruneUntil)
+		if err != nil {
+			Error.Fatalf("Error: %s", err)
+		}
+		result, err := runPrune(pruneOptions{All: *pruneAll, DryRun: *pruneDryRun, Until: until})
+		if err != nil {
+			Error.Fatalf("Error: %s", err)
+		}
+		verb := "Removed"
+		if *pruneDryRun {
+			verb = "Would remove"
+		}
+		for _, name := range result.Containers {
+			Info.Printf("%s working container '%s'", verb, name)
+		}
+		for _, ref := range result.Images {
+			Info.Printf("%s intermediate image '%s'", verb, ref)
+		}
+		Info.Printf("%s %d container(s) and %d image(s)", verb, len(result.Containers), len(result.Images))
 
 	case "run":
 		findContainerRuntime()
@@ -140,34 +203,35 @@ func main() {
 		if runCmdArgs != nil && len(*runCmdArgs) > 0 {
 			command = *runCmdArgs
 		}
+		name := resolveName(*runRecipe, listAll())
 		for _, r := range listSdks() {
-			if r == *runRecipe {
-				sdk := parseSdkConfig(*runRecipe)
+			if r == name {
+				sdk := parseSdkConfig(name)
 				sdk.run(command)
 				return
 			}
 		}
-		r := parseRecipeConfig(*runRecipe)
+		r := parseRecipeConfig(name)
 		r.run(command)
 
 	case "build":
 		findContainerRuntime()
-		recipe := parseRecipeConfig(*buildRecipe)
+		recipe := parseRecipeConfig(resolveName(*buildRecipe, listRecipes()))
 		recipe.action("build")
 
 	case "image":
 		findContainerRuntime()
-		recipe := parseRecipeConfig(*imageRecipe)
+		recipe := parseRecipeConfig(resolveName(*imageRecipe, listRecipes()))
 		recipe.action("image")
 
 	case "configure":
 		findContainerRuntime()
-		recipe := parseRecipeConfig(*configureRecipe)
+		recipe := parseRecipeConfig(resolveName(*configureRecipe, listRecipes()))
 		recipe.action("configure")
 
 	case "bundle":
 		findContainerRuntime()
-		recipe := parseRecipeConfig(*bundleRecipe)
+		recipe := parseRecipeConfig(resolveName(*bundleRecipe, listRecipes()))
 		recipe.action("bundle")
 
 	case testSetupCmd.FullCommand():
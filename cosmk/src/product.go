@@ -32,30 +32,32 @@ func parseProductConfig() *product {
 	return &p
 }
 
-func (p *product) do() error {
-	for _, recipe := range p.Recipes {
-		r := parseRecipeConfig(recipe)
-		err := r.do()
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+// do runs every recipe of the product, respecting each recipe's
+// 'depends_on' and running up to 'jobs' independent recipes concurrently.
+func (p *product) do(jobs int) error {
+	return runScheduler(p.Recipes, jobs, func(name string) error {
+		return parseRecipeConfig(name).do()
+	})
 }
 
-func (p *product) reconfigure() error {
-	for _, recipe := range p.Recipes {
-		r := parseRecipeConfig(recipe)
+// reconfigure re-applies every recipe's 'script' actions other than 'build'
+// and 'image', respecting each recipe's 'depends_on' and running up to
+// 'jobs' independent recipes concurrently.
+func (p *product) reconfigure(jobs int) error {
+	return runScheduler(p.Recipes, jobs, func(name string) error {
+		r := parseRecipeConfig(name)
 		for _, action := range r.Actions {
-			if (action != "build") && (action != "image") {
-				err := r.action(action)
-				if err != nil {
+			if action.Kind != recipeActionScript {
+				continue
+			}
+			if (action.Script != "build") && (action.Script != "image") {
+				if err := r.action(action.Script); err != nil {
 					return err
 				}
 			}
 		}
-	}
-	return nil
+		return nil
+	})
 }
 
 func (p *product) env() []string {
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// workingContainerPattern matches the '<product>_<recipe>.<action>.working'
+// (and '...actionN.working') names used for the short-lived containers
+// sdk.bootstrap() and recipeBuilder create, so a crash or Ctrl-C between
+// create and remove doesn't leak them forever.
+var workingContainerPattern = regexp.MustCompile(`\.working$`)
+
+// pruneOptions configures a prune run; it is the 'opts' argument of
+// runPrune(opts).
+type pruneOptions struct {
+	All    bool          // also remove dangling 'cosmk.cache.key'-labeled cache layers
+	DryRun bool          // report what would be removed without removing it
+	Until  time.Duration // only consider resources older than this, 0 means no age filter
+}
+
+// pruneResult lists what a prune run removed (or would remove, for a dry
+// run), for both the CLI summary and programmatic callers.
+type pruneResult struct {
+	Containers []string
+	Images     []string
+}
+
+// runPrune removes working containers left over from interrupted
+// bootstraps/builds, '.bootstrap' intermediate images whose final tag has
+// since been produced, and, with opts.All, any untagged image carrying a
+// 'cosmk.cache.key' label.
+func runPrune(opts pruneOptions) (pruneResult, error) {
+	var result pruneResult
+
+	containers, err := runtime.listContainers()
+	if err != nil {
+		return result, fmt.Errorf("could not list containers: %s", err)
+	}
+	for _, c := range containers {
+		if !workingContainerPattern.MatchString(c.Name) {
+			continue
+		}
+		if !olderThan(c.Created, opts.Until) {
+			continue
+		}
+		if !opts.DryRun {
+			if err := runtime.removeContainer(c.Name); err != nil {
+				Debug.Printf("Could not remove working container '%s': %s", c.Name, err)
+				continue
+			}
+		}
+		result.Containers = append(result.Containers, c.Name)
+	}
+
+	images, err := runtime.listImages()
+	if err != nil {
+		return result, fmt.Errorf("could not list images: %s", err)
+	}
+	present := map[string]bool{}
+	for _, img := range images {
+		for _, tag := range img.Tags {
+			present[tag] = true
+		}
+	}
+
+	for _, img := range images {
+		if !olderThan(img.Created, opts.Until) {
+			continue
+		}
+
+		for _, tag := range img.Tags {
+			if isDanglingBootstrap(tag, present) {
+				if err := pruneImage(tag, opts.DryRun, &result); err != nil {
+					Debug.Printf("Could not remove intermediate image '%s': %s", tag, err)
+				}
+			}
+		}
+
+		if opts.All && img.Labels["cosmk.cache.key"] != "" && len(img.Tags) == 0 {
+			if err := pruneImage(img.ID, opts.DryRun, &result); err != nil {
+				Debug.Printf("Could not remove cache layer '%s': %s", img.ID, err)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// isDanglingBootstrap reports whether tag is a '<repo>:<version>.bootstrap'
+// image whose corresponding final '<repo>:<version>' image is also present.
+func isDanglingBootstrap(tag string, present map[string]bool) bool {
+	repo, version := splitImageTag(tag)
+	if !strings.HasSuffix(version, ".bootstrap") {
+		return false
+	}
+	final := fmt.Sprintf("%s:%s", repo, strings.TrimSuffix(version, ".bootstrap"))
+	return present[final]
+}
+
+func pruneImage(ref string, dryRun bool, result *pruneResult) error {
+	if !dryRun {
+		if err := runtime.removeImage(ref); err != nil {
+			return err
+		}
+	}
+	result.Images = append(result.Images, ref)
+	return nil
+}
+
+func olderThan(created time.Time, until time.Duration) bool {
+	if until == 0 {
+		return true
+	}
+	return time.Since(created) >= until
+}
+
+// parsePruneFilter parses the '--filter' flag's only supported form,
+// 'until=<duration>' (e.g. 'until=24h'), returning 0 for an empty filter.
+func parsePruneFilter(filter string) (time.Duration, error) {
+	if filter == "" {
+		return 0, nil
+	}
+	value := strings.TrimPrefix(filter, "until=")
+	if value == filter {
+		return 0, fmt.Errorf("unsupported filter '%s', only 'until=<duration>' is supported", filter)
+	}
+	return time.ParseDuration(value)
+}
@@ -11,14 +11,16 @@ import (
 
 type recipeToml struct {
 	Sdk         string
-	Actions     []string
+	Actions     []recipeActionToml
 	Environment map[string]string
+	Depends_on  []string
 }
 
 type recipe struct {
 	Name        string
-	Actions     []string
+	Actions     []recipeAction
 	Environment map[string]string
+	Depends_on  []string
 	Sdk         *sdk
 	Product     *product
 }
@@ -39,41 +41,81 @@ func parseRecipeConfig(name string) recipe {
 
 	s := parseSdkConfig(r.Sdk)
 
+	actions := make([]recipeAction, len(r.Actions))
+	for i, a := range r.Actions {
+		action, err := a.toAction()
+		if err != nil {
+			Error.Fatalf("Could not parse action %d of recipe '%s': %s", i, name, err)
+		}
+		actions[i] = action
+	}
+
 	return recipe{
 		Name:        name,
-		Actions:     r.Actions,
+		Actions:     actions,
 		Environment: r.Environment,
+		Depends_on:  r.Depends_on,
 		Sdk:         &s,
 		Product:     product,
 	}
 }
 
+// outputImage is the stable tag the last layer built by do() is published
+// under, so other recipes can refer to this recipe's output the same way
+// they refer to an SDK image.
+func (r *recipe) outputImage() string {
+	return newImageRef(fmt.Sprintf("%s.recipe", r.Name), r.Sdk.Tag).RepositoryTag()
+}
+
+// do bootstraps the recipe's SDK, then runs its action pipeline: 'run' and
+// 'copy' instructions are built up as cached image layers on top of the SDK
+// image (see recipeBuilder), 'env' adjusts the environment of later 'run'
+// instructions and 'workdir' the working directory of later 'run'
+// instructions and relative 'copy' destinations, and 'script'
+// instructions invoke the named '<name>.sh' action against those
+// accumulated layers. The final layer is tagged as r.outputImage().
 func (r *recipe) do() error {
 	err := r.Sdk.bootstrap()
 	if err != nil {
 		return err
 	}
-	for _, action := range r.Actions {
-		err = r.action(action)
-		if err != nil {
-			return err
-		}
+
+	if len(r.Actions) == 0 {
+		return nil
 	}
-	return nil
+
+	baseImage := newImageRef(r.Sdk.Name, r.Sdk.Tag).RepositoryTag()
+
+	b := newRecipeBuilder(r)
+	lastStep, err := b.build(baseImage)
+	if err != nil {
+		return err
+	}
+
+	return runtime.tag(lastStep, r.outputImage())
 }
 
+// action bootstraps the recipe's SDK and runs the named '<name>.sh' action
+// against the base SDK image, the way recipes always have.
 func (r *recipe) action(action string) error {
 	err := r.Sdk.bootstrap()
 	if err != nil {
 		return err
 	}
 
+	return r.actionOn(newImageRef(r.Sdk.Name, r.Sdk.Tag).RepositoryTag(), action)
+}
+
+// actionOn runs the named '<name>.sh' action against image, which need not
+// be the base SDK image: a 'script' instruction in a recipe's action
+// pipeline uses this to see whatever 'run'/'copy' layers precede it.
+func (r *recipe) actionOn(image string, action string) error {
 	// Search for the action script in the recipe directory first and if not
 	// found, use the default one from the SDK
 	hostCommand := path.Join(repoRootPath, "products", r.Product.Short_name,
 		r.Name, fmt.Sprintf("%s.sh", action))
 	sdkCommand := path.Join("/mnt", "products", r.Product.Short_name, r.Name, fmt.Sprintf("%s.sh", action))
-	_, err = os.Stat(hostCommand)
+	_, err := os.Stat(hostCommand)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			Error.Fatalf("Could not access file '%s': %s", hostCommand, err)
@@ -81,8 +123,7 @@ func (r *recipe) action(action string) error {
 		sdkCommand = fmt.Sprintf("./%s.sh", action)
 	}
 
-	imageName := fmt.Sprintf("%s/%s", rootConfig.Product.Name, r.Sdk.Name)
-	return runtime.run(fmt.Sprintf("%s:%s", imageName, r.Sdk.Tag), []string{sdkCommand}, action, r.Sdk, r)
+	return runtime.run(image, []string{sdkCommand}, action, r.Sdk, r)
 }
 
 func (r *recipe) env() []string {
@@ -100,6 +141,5 @@ func (r *recipe) run(command []string) error {
 	if err != nil {
 		return err
 	}
-	imageName := fmt.Sprintf("%s/%s", rootConfig.Product.Name, r.Sdk.Name)
-	return runtime.run(fmt.Sprintf("%s:%s", imageName, r.Sdk.Tag), command, "run", r.Sdk, r)
+	return runtime.run(newImageRef(r.Sdk.Name, r.Sdk.Tag).RepositoryTag(), command, "run", r.Sdk, r)
 }
@@ -0,0 +1,117 @@
+package main
+
+import "fmt"
+
+type recipeActionKind string
+
+const (
+	recipeActionRun     recipeActionKind = "run"
+	recipeActionCopy    recipeActionKind = "copy"
+	recipeActionEnv     recipeActionKind = "env"
+	recipeActionWorkdir recipeActionKind = "workdir"
+	recipeActionScript  recipeActionKind = "script"
+)
+
+// recipeAction is a single instruction of a recipe's action pipeline,
+// borrowed from the Dockerfile instruction model: run a command, copy a
+// file or directory in, set environment variables, change the working
+// directory used by later instructions, or (for back-compat) invoke a
+// '<name>.sh' action script the way recipe.action() always has.
+type recipeAction struct {
+	Kind    recipeActionKind
+	Run     string
+	Copy    recipeActionCopy
+	Env     map[string]string
+	Workdir string
+	Script  string
+}
+
+type recipeActionCopy struct {
+	Src string
+	Dst string
+}
+
+// recipeActionToml is the shape a single entry of 'actions' takes in
+// recipe.toml, e.g. '{ run = "emerge foo" }' or
+// '{ copy = { src = "files/x", dst = "/etc/x" } }'. Exactly one field must
+// be set.
+type recipeActionToml struct {
+	Run     string
+	Copy    *recipeActionCopy
+	Env     map[string]string
+	Workdir string
+	Script  string
+}
+
+// UnmarshalTOML lets an 'actions' entry be either an inline table (the
+// current instruction model, e.g. '{ run = "emerge foo" }') or, for
+// back-compat with pre-instruction 'actions = ["build", "image"]' recipes, a
+// plain string, treated as '{ script = "<name>" }'.
+func (t *recipeActionToml) UnmarshalTOML(data interface{}) error {
+	if name, ok := data.(string); ok {
+		t.Script = name
+		return nil
+	}
+
+	table, ok := data.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("recipe action must be a string or a table, got %T", data)
+	}
+
+	if v, ok := table["run"].(string); ok {
+		t.Run = v
+	}
+	if v, ok := table["copy"].(map[string]interface{}); ok {
+		copy := recipeActionCopy{}
+		if src, ok := v["src"].(string); ok {
+			copy.Src = src
+		}
+		if dst, ok := v["dst"].(string); ok {
+			copy.Dst = dst
+		}
+		t.Copy = &copy
+	}
+	if v, ok := table["env"].(map[string]interface{}); ok {
+		env := make(map[string]string, len(v))
+		for k, val := range v {
+			if s, ok := val.(string); ok {
+				env[k] = s
+			}
+		}
+		t.Env = env
+	}
+	if v, ok := table["workdir"].(string); ok {
+		t.Workdir = v
+	}
+	if v, ok := table["script"].(string); ok {
+		t.Script = v
+	}
+	return nil
+}
+
+// toAction converts the TOML inline table into a recipeAction, checking
+// that exactly one instruction kind was set.
+func (t recipeActionToml) toAction() (recipeAction, error) {
+	var kinds []recipeAction
+
+	if t.Run != "" {
+		kinds = append(kinds, recipeAction{Kind: recipeActionRun, Run: t.Run})
+	}
+	if t.Copy != nil {
+		kinds = append(kinds, recipeAction{Kind: recipeActionCopy, Copy: *t.Copy})
+	}
+	if len(t.Env) > 0 {
+		kinds = append(kinds, recipeAction{Kind: recipeActionEnv, Env: t.Env})
+	}
+	if t.Workdir != "" {
+		kinds = append(kinds, recipeAction{Kind: recipeActionWorkdir, Workdir: t.Workdir})
+	}
+	if t.Script != "" {
+		kinds = append(kinds, recipeAction{Kind: recipeActionScript, Script: t.Script})
+	}
+
+	if len(kinds) != 1 {
+		return recipeAction{}, fmt.Errorf("recipe action must set exactly one of 'run', 'copy', 'env', 'workdir' or 'script', got %d", len(kinds))
+	}
+	return kinds[0], nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// recipeBuilder runs a recipe's action pipeline against the recipe's
+// bootstrapped SDK image the same way sdkBuilder runs an SDK's bootstrap
+// steps: a 'run' or 'copy' instruction creates a working container from the
+// current parent image, does its work, and is committed as a new
+// content-addressable layer that becomes the parent of the next
+// instruction. 'env' instructions carry forward into later 'run'
+// instructions and 'workdir' into later 'run' instructions and relative
+// 'copy' destinations but, unlike Dockerfile ENV/WORKDIR, they are not
+// baked into a committed layer of their own. 'script' instructions run via
+// recipe.actionOn() against the current parent image, so they see whatever
+// 'run'/'copy' layers preceded them, rather than as a cached layer of their
+// own.
+type recipeBuilder struct {
+	Recipe    *recipe
+	ImageName string
+	NoCache   bool
+
+	env     map[string]string
+	workdir string
+}
+
+func newRecipeBuilder(r *recipe) *recipeBuilder {
+	return &recipeBuilder{
+		Recipe:    r,
+		ImageName: newImageRef(fmt.Sprintf("%s.recipe", r.Name), "").Repository(),
+		NoCache:   *noCache,
+		env:       map[string]string{},
+	}
+}
+
+// build runs every action of r.Actions in order on top of baseImage and
+// returns the reference of the last intermediate image produced.
+func (b *recipeBuilder) build(baseImage string) (string, error) {
+	parent := baseImage
+	for i, action := range b.Recipe.Actions {
+		next, err := b.runAction(i, action, parent)
+		if err != nil {
+			return "", fmt.Errorf("action %d ('%s') failed: %s", i, action.Kind, err)
+		}
+		parent = next
+	}
+	return parent, nil
+}
+
+func (b *recipeBuilder) runAction(index int, action recipeAction, parentImage string) (string, error) {
+	switch action.Kind {
+	case recipeActionEnv:
+		for k, v := range action.Env {
+			b.env[k] = v
+		}
+		return parentImage, nil
+
+	case recipeActionWorkdir:
+		b.workdir = action.Workdir
+		return parentImage, nil
+
+	case recipeActionRun:
+		Info.Printf("Running recipe action %d/%d: %s", index+1, len(b.Recipe.Actions), action.Run)
+		return b.runCommand(index, parentImage, []string{"/bin/sh", "-c", action.Run}, action.Run)
+
+	case recipeActionCopy:
+		Info.Printf("Running recipe action %d/%d: copy '%s' to '%s'", index+1, len(b.Recipe.Actions), action.Copy.Src, action.Copy.Dst)
+		return b.runCopy(index, parentImage, action.Copy)
+
+	case recipeActionScript:
+		Info.Printf("Running recipe action %d/%d: script '%s'", index+1, len(b.Recipe.Actions), action.Script)
+		return parentImage, b.Recipe.actionOn(parentImage, action.Script)
+
+	default:
+		return "", fmt.Errorf("unknown recipe action kind '%s'", action.Kind)
+	}
+}
+
+// runCommand runs a 'run' instruction in a working container created from
+// parentImage and commits the result under a cache key derived from
+// parentImage and the command, unless an image already exists under that
+// key.
+func (b *recipeBuilder) runCommand(index int, parentImage string, command []string, descriptor string) (string, error) {
+	stepImage, cacheKey, found, err := b.lookupCacheEntry(parentImage, "run:"+descriptor)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		Debug.Printf("Cache hit for recipe action %d, reusing '%s'", index, stepImage)
+		return stepImage, nil
+	}
+
+	workContainer := b.workContainerName(index)
+	runtime.removeContainer(workContainer)
+
+	err = runtime.runBuildStep(parentImage, command, workContainer, b.env, b.workdir, b.Recipe.Sdk, b.Recipe, "build")
+	if err != nil {
+		return "", err
+	}
+
+	return stepImage, b.commitAndCleanup(index, workContainer, stepImage, cacheKey)
+}
+
+// runCopy runs a 'copy' instruction: it creates a working container from
+// parentImage, copies the recipe-relative source path into it, and commits
+// the result. The cache key folds in a digest of the source so that editing
+// a copied file invalidates the cache the same way changing a command does.
+func (b *recipeBuilder) runCopy(index int, parentImage string, c recipeActionCopy) (string, error) {
+	hostSrc := path.Join(repoRootPath, "products", rootConfig.Product.Name, b.Recipe.Name, c.Src)
+
+	digest, err := pathDigest(hostSrc)
+	if err != nil {
+		return "", fmt.Errorf("could not read copy source '%s': %s", c.Src, err)
+	}
+	dst := c.Dst
+	if !path.IsAbs(dst) && b.workdir != "" {
+		dst = path.Join(b.workdir, dst)
+	}
+	descriptor := fmt.Sprintf("copy:%s:%s:%s", c.Src, dst, digest)
+
+	stepImage, cacheKey, found, err := b.lookupCacheEntry(parentImage, descriptor)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		Debug.Printf("Cache hit for recipe action %d, reusing '%s'", index, stepImage)
+		return stepImage, nil
+	}
+
+	workContainer := b.workContainerName(index)
+	runtime.removeContainer(workContainer)
+
+	err = runtime.createWorkingContainer(parentImage, workContainer)
+	if err != nil {
+		return "", err
+	}
+
+	err = runtime.copyToContainer(workContainer, hostSrc, dst)
+	if err != nil {
+		return "", err
+	}
+
+	return stepImage, b.commitAndCleanup(index, workContainer, stepImage, cacheKey)
+}
+
+func (b *recipeBuilder) workContainerName(index int) string {
+	return fmt.Sprintf("%s_%s.recipe.action%d.working", b.Recipe.Product.Short_name, b.Recipe.Name, index)
+}
+
+// lookupCacheEntry computes the step image tag and cache key for
+// (parentImage, descriptor) and reports whether the tag already exists in
+// local storage.
+func (b *recipeBuilder) lookupCacheEntry(parentImage string, descriptor string) (stepImage string, cacheKey string, found bool, err error) {
+	cacheKey, err = cacheKeyFor(parentImage, descriptor)
+	if err != nil {
+		return "", "", false, fmt.Errorf("could not compute cache key: %s", err)
+	}
+	stepImage = fmt.Sprintf("%s:step-%s", b.ImageName, cacheKey[:16])
+
+	if b.NoCache {
+		return stepImage, cacheKey, false, nil
+	}
+	found, err = runtime.imageExists(stepImage)
+	if err != nil {
+		return stepImage, cacheKey, false, nil
+	}
+	return stepImage, cacheKey, found, nil
+}
+
+func (b *recipeBuilder) commitAndCleanup(index int, workContainer string, stepImage string, cacheKey string) error {
+	err := runtime.commitWithLabels(workContainer, stepImage, map[string]string{"cosmk.cache.key": cacheKey})
+	if err != nil {
+		return fmt.Errorf("could not commit action %d: %s", index, err)
+	}
+
+	err = runtime.removeContainer(workContainer)
+	if err != nil {
+		Debug.Printf("Could not remove working container '%s': %s", workContainer, err)
+	}
+	return nil
+}
+
+// pathDigest returns a sha256 digest covering the content of hostPath (and,
+// for a directory, the relative path of each entry), used to tell whether a
+// 'copy' instruction's source has changed since it was last cached.
+func pathDigest(hostPath string) (string, error) {
+	info, err := os.Stat(hostPath)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	if !info.IsDir() {
+		f, err := os.Open(hostPath)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	err = filepath.Walk(hostPath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(hostPath, p)
+		if err != nil {
+			return err
+		}
+		io.WriteString(h, rel)
+		if fi.IsDir() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// tarForCopy archives hostPath (a file or directory) into a tar stream
+// rooted so that extracting it into path.Dir(dstPath) reproduces dstPath,
+// the way 'podman cp'/'docker cp' expect.
+func tarForCopy(hostPath string, dstPath string) (*bytes.Buffer, string, error) {
+	info, err := os.Stat(hostPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not stat copy source '%s': %s", hostPath, err)
+	}
+
+	destDir := path.Dir(dstPath)
+	rootName := path.Base(dstPath)
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+
+	if info.IsDir() {
+		err = filepath.Walk(hostPath, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(hostPath, p)
+			if err != nil {
+				return err
+			}
+			name := rootName
+			if rel != "." {
+				name = path.Join(rootName, filepath.ToSlash(rel))
+			}
+			return addTarEntry(tw, p, name, fi)
+		})
+	} else {
+		err = addTarEntry(tw, hostPath, rootName, info)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf, destDir, nil
+}
+
+func addTarEntry(tw *tar.Writer, hostPath string, name string, info os.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+
+	f, err := os.Open(hostPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -2,19 +2,33 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"os/user"
 	"path"
 	"strings"
+	"time"
+
+	"github.com/containers/podman/v4/libpod/define"
+	"github.com/containers/podman/v4/pkg/bindings"
+	"github.com/containers/podman/v4/pkg/bindings/containers"
+	"github.com/containers/podman/v4/pkg/bindings/images"
+	"github.com/containers/podman/v4/pkg/specgen"
 )
 
 var runtime containerRuntime
 
+// containerRuntime talks to a container engine. When the engine is podman it
+// drives it directly through the bindings API over the (rootless or root)
+// podman socket; when podman is not available it falls back to a Docker
+// engine client (see docker.go). Either way no 'sudo docker'/'sudo podman'
+// subprocess is spawned anymore.
 type containerRuntime struct {
-	Cmd  string
-	Sudo bool
+	Kind   string // "podman" or "docker"
+	ctx    context.Context
+	docker *dockerEngine
 }
 
 // Figure out which container runtime to use between:
@@ -22,61 +36,74 @@ type containerRuntime struct {
 // * privileged podman
 // * Docker
 func findContainerRuntime() {
-	path, err := exec.LookPath("podman")
-	if err == nil {
-		Debug.Println("Found 'podman' at ", path)
-		runtime = containerRuntime{Cmd: "podman", Sudo: true}
-
-		// Are subuids configured? (Required for rootless)
-		file, err := os.Open("/etc/subuid")
-		if err != nil {
+	if uri, ok := podmanSocketURI(); ok {
+		ctx, err := bindings.NewConnection(context.Background(), uri)
+		if err == nil {
+			Debug.Printf("Connected to podman at '%s'", uri)
+			runtime = containerRuntime{Kind: "podman", ctx: ctx}
 			return
 		}
-		defer file.Close()
+		Debug.Printf("Could not connect to podman at '%s': %s", uri, err)
+	}
 
-		user, err := user.Current()
-		if err != nil {
-			return
-		}
-		username := user.Username
+	docker, err := newDockerEngine()
+	if err == nil {
+		Debug.Println("Connected to docker engine")
+		runtime = containerRuntime{Kind: "docker", docker: docker}
+		return
+	}
 
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			split := strings.Split(scanner.Text(), ":")
-			if len(split) != 0 && split[0] == username {
-				runtime.Sudo = false
-				return
-			}
-		}
+	Error.Fatalln("Could not connect to either 'podman' or 'docker'!")
+}
 
-		// Did not find any subuid for our current username. Running as root with sudo
-		return
+// podmanSocketURI returns the user podman socket when the current user has a
+// subuid range configured (rootless), or the root podman socket otherwise.
+// The second return value is always true: whether podman is reachable at
+// that URI is only found out when findContainerRuntime connects to it.
+func podmanSocketURI() (string, bool) {
+	rootURI := "unix:/run/podman/podman.sock"
+
+	file, err := os.Open("/etc/subuid")
+	if err != nil {
+		return rootURI, true
 	}
+	defer file.Close()
 
-	path, err = exec.LookPath("docker")
-	if err == nil {
-		Debug.Println("Found 'docker' at ", path)
-		runtime = containerRuntime{Cmd: "docker", Sudo: true}
-		return
+	u, err := user.Current()
+	if err != nil {
+		return rootURI, true
 	}
 
-	Error.Fatalln("Could not find either 'podman' or 'docker in path!")
-	runtime = containerRuntime{Cmd: "false", Sudo: false}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		split := strings.Split(scanner.Text(), ":")
+		if len(split) != 0 && split[0] == u.Username {
+			runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+			if runtimeDir == "" {
+				runtimeDir = fmt.Sprintf("/run/user/%s", u.Uid)
+			}
+			return fmt.Sprintf("unix:%s/podman/podman.sock", runtimeDir), true
+		}
+	}
+
+	return rootURI, true
 }
 
+// findCiImage is bootstrap()'s entry point for requirement (1): if name:version
+// is already present locally (from an earlier pull), nothing more to do;
+// otherwise it is pulled from rootConfig.Ci.Registry into local storage
+// before returning, so a CI-built cache is actually usable as-is afterwards.
 func (cr *containerRuntime) findCiImage(name string, version string) error {
-	image := fmt.Sprintf("%s/%s:%s", rootConfig.Ci.Registry, name, version)
-	Debug.Printf("Looking for image '%s' in local registry", image)
+	local := fmt.Sprintf("%s:%s", name, version)
+	Debug.Printf("Looking for image '%s' in local storage", local)
 
-	cmd := cr.command()
-	cmd.Args = append(cmd.Args, "inspect", image)
-	err := cmd.Run()
-	if err == nil {
-		Debug.Printf("Found image '%s' in local registry", image)
+	found, err := cr.imageExists(local)
+	if err == nil && found {
+		Debug.Printf("Found image '%s' in local storage", local)
 		return nil
 	}
 
-	Info.Printf("Could not find image '%s' in local registry", image)
+	Debug.Printf("Image '%s' not found locally, looking in CI registry", local)
 
 	return cr.pullImageFromCi(name, version)
 }
@@ -85,63 +112,321 @@ func (cr *containerRuntime) findLocalImage(name string, version string) error {
 	image := fmt.Sprintf("%s/%s:%s", "localhost", name, version)
 	Debug.Printf("Looking for image '%s' in local registry", image)
 
-	cmd := cr.command()
-	cmd.Args = append(cmd.Args, "inspect", image)
-	err := cmd.Run()
-	if err == nil {
+	found, err := cr.imageExists(image)
+	if err == nil && found {
 		Debug.Printf("Found image '%s' in local registry", image)
 		return nil
 	}
 
 	Error.Printf("Could not find image '%s' in local registry", image)
-	return err
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("image '%s' not found", image)
+}
+
+func (cr *containerRuntime) imageExists(image string) (bool, error) {
+	switch cr.Kind {
+	case "podman":
+		return images.Exists(cr.ctx, image, nil)
+	case "docker":
+		return cr.docker.imageExists(image)
+	default:
+		return false, fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
+}
+
+// imageID resolves the content-addressable ID of an already-pulled or
+// already-built image, used to derive bootstrap step cache keys.
+func (cr *containerRuntime) imageID(image string) (string, error) {
+	switch cr.Kind {
+	case "podman":
+		report, err := images.GetImage(cr.ctx, image, nil)
+		if err != nil {
+			return "", err
+		}
+		return report.ID, nil
+	case "docker":
+		return cr.docker.imageID(image)
+	default:
+		return "", fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
 }
 
+// pullImageFromCi pulls name:version from rootConfig.Ci.Registry and tags it
+// locally under its plain, unprefixed name:version so the rest of the
+// toolchain (findLocalImage, commit, run...) can use it exactly as it would
+// an image built locally, instead of only under its registry-qualified tag.
 func (cr *containerRuntime) pullImageFromCi(name string, version string) error {
+	ref := fmt.Sprintf("%s/%s:%s", rootConfig.Ci.Registry, name, version)
+	local := fmt.Sprintf("%s:%s", name, version)
 	Info.Printf("Pulling image '%s:%s' from '%s'", name, version, rootConfig.Ci.Registry)
-	cmd := cr.command()
-	cmd.Args = append(cmd.Args, "pull", fmt.Sprintf("%s/%s:%s", rootConfig.Ci.Registry, name, version))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	emitEvent("image-pull-start", map[string]interface{}{"image": ref})
+
+	err := cr.pull(ref)
 	if err != nil {
 		Info.Printf("Could not pull '%s:%s' from '%s'", name, version, rootConfig.Ci.Registry)
+		emitEvent("image-pull-finish", map[string]interface{}{"image": ref, "error": err.Error()})
 		return err
 	}
+
+	err = cr.tag(ref, local)
+	if err != nil {
+		emitEvent("image-pull-finish", map[string]interface{}{"image": ref, "error": err.Error()})
+		return fmt.Errorf("could not tag pulled image '%s' as '%s': %s", ref, local, err)
+	}
+
 	Info.Printf("Pulled image '%s:%s' from '%s'", name, version, rootConfig.Ci.Registry)
+	emitEvent("image-pull-finish", map[string]interface{}{"image": ref})
 	return nil
 }
 
-func (cr *containerRuntime) command() *exec.Cmd {
-	var cmd *exec.Cmd
-	if cr.Sudo {
-		cmd = exec.Command("sudo")
-		cmd.Args = []string{"sudo", cr.Cmd}
+// registryAuthFor looks up the push/pull credentials configured for ref's
+// registry host under '[ci.auth]' in config.toml, if any.
+func registryAuthFor(ref string) (username string, password string, insecureTLS bool) {
+	registry := strings.SplitN(ref, "/", 2)[0]
+	auth, ok := rootConfig.Ci.Auth[registry]
+	if !ok {
+		return "", "", false
+	}
 
-	} else {
-		cmd = exec.Command(runtime.Cmd)
-		cmd.Args = []string{cr.Cmd}
+	username = auth.Username
+	password = auth.Password
+	if auth.Token_file != "" {
+		data, err := ioutil.ReadFile(auth.Token_file)
+		if err != nil {
+			Error.Fatalf("Could not read token file '%s': %s", auth.Token_file, err)
+		}
+		password = strings.TrimSpace(string(data))
 	}
-	return cmd
+	return username, password, auth.Insecure_tls
 }
 
-func (cr *containerRuntime) run(image string, command []string, action string, s *sdk, r *recipe) error {
-	cmd := cr.command()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
+// pull fetches ref into local storage, authenticating against '[ci.auth]'
+// when the registry it points at is configured there.
+func (cr *containerRuntime) pull(ref string) error {
+	username, password, insecureTLS := registryAuthFor(ref)
+
+	switch cr.Kind {
+	case "podman":
+		_, err := images.Pull(cr.ctx, ref, &images.PullOptions{
+			Username:      &username,
+			Password:      &password,
+			SkipTLSVerify: boolPtr(insecureTLS),
+		})
+		return err
+	case "docker":
+		return cr.docker.pullWithAuth(ref, username, password)
+	default:
+		return fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
+}
+
+// push publishes the local image ref to its registry, authenticating
+// against '[ci.auth]' when the registry it points at is configured there.
+func (cr *containerRuntime) push(ref string) error {
+	username, password, insecureTLS := registryAuthFor(ref)
+
+	switch cr.Kind {
+	case "podman":
+		return images.Push(cr.ctx, ref, ref, &images.PushOptions{
+			Username:      &username,
+			Password:      &password,
+			SkipTLSVerify: boolPtr(insecureTLS),
+		})
+	case "docker":
+		return cr.docker.pushWithAuth(ref, username, password)
+	default:
+		return fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
+}
+
+// importRootfs imports a rootfs tarball as the base layer of 'image'.
+func (cr *containerRuntime) importRootfs(rootfsPath string, image string) error {
+	switch cr.Kind {
+	case "podman":
+		f, err := os.Open(rootfsPath)
+		if err != nil {
+			return fmt.Errorf("could not open rootfs '%s': %s", rootfsPath, err)
+		}
+		defer f.Close()
+		_, err = images.Import(cr.ctx, f, &images.ImportOptions{Reference: &image})
+		return err
+	case "docker":
+		return cr.docker.importRootfs(rootfsPath, image)
+	default:
+		return fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
+}
+
+// removeContainer removes a (possibly non-existent) container by name,
+// ignoring the case where it is already gone.
+func (cr *containerRuntime) removeContainer(name string) error {
+	switch cr.Kind {
+	case "podman":
+		force := true
+		_, err := containers.Remove(cr.ctx, name, &containers.RemoveOptions{Force: &force})
+		return err
+	case "docker":
+		return cr.docker.removeContainer(name)
+	default:
+		return fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
+}
+
+// removeImage removes an image by ID or tag, used by prune to collect
+// stale bootstrap intermediates and cache layers.
+func (cr *containerRuntime) removeImage(image string) error {
+	switch cr.Kind {
+	case "podman":
+		force := true
+		_, errs := images.Remove(cr.ctx, []string{image}, &images.RemoveOptions{Force: &force})
+		if len(errs) > 0 {
+			return errs[0]
+		}
+		return nil
+	case "docker":
+		return cr.docker.removeImage(image)
+	default:
+		return fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
+}
+
+// commit commits the working container identified by name to image.
+func (cr *containerRuntime) commit(name string, image string) error {
+	switch cr.Kind {
+	case "podman":
+		repo, tag := splitImageTag(image)
+		_, err := containers.Commit(cr.ctx, name, &containers.CommitOptions{
+			Repo: &repo,
+			Tag:  &tag,
+		})
+		return err
+	case "docker":
+		return cr.docker.commit(name, image)
+	default:
+		return fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
+}
+
+// commitWithLabels is like commit but also stamps the committed image with
+// labels, recorded as Dockerfile-style 'LABEL' changes. Used by the builders
+// to tag their cache layers with a 'cosmk.cache.key' label, so 'cosmk prune
+// --all' can find them without having to parse step image tags.
+func (cr *containerRuntime) commitWithLabels(name string, image string, labels map[string]string) error {
+	var changes []string
+	for k, v := range labels {
+		changes = append(changes, fmt.Sprintf("LABEL %s=%s", k, v))
+	}
+
+	switch cr.Kind {
+	case "podman":
+		repo, tag := splitImageTag(image)
+		_, err := containers.Commit(cr.ctx, name, &containers.CommitOptions{
+			Repo:    &repo,
+			Tag:     &tag,
+			Changes: changes,
+		})
+		return err
+	case "docker":
+		return cr.docker.commitWithLabels(name, image, changes)
+	default:
+		return fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
+}
 
-	cmd.Args = append(cmd.Args, "run")
+// tag adds the repo:tag of targetImage onto an existing image.
+func (cr *containerRuntime) tag(existingImage string, targetImage string) error {
+	repo, tag := splitImageTag(targetImage)
+	switch cr.Kind {
+	case "podman":
+		return images.Tag(cr.ctx, existingImage, tag, repo, nil)
+	case "docker":
+		return cr.docker.tag(existingImage, targetImage)
+	default:
+		return fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
+}
 
-	// Disable SELinux confinement to enable access to home directory content
-	cmd.Args = append(cmd.Args, "--security-opt", "label=disable")
+func splitImageTag(image string) (repo string, tag string) {
+	repo, tag = parseRepositoryTag(image)
+	if tag == "" {
+		tag = "latest"
+	}
+	return repo, tag
+}
+
+// imageSummary is a runtime-agnostic summary of a stored image, just enough
+// to resolve an expandID lookup and for prune to find GC candidates.
+type imageSummary struct {
+	ID      string
+	Tags    []string
+	Labels  map[string]string
+	Created time.Time
+}
+
+// listImages lists every image in local storage, used by expandID to
+// resolve a short ID or partial name, and by prune to find GC candidates.
+func (cr *containerRuntime) listImages() ([]imageSummary, error) {
+	switch cr.Kind {
+	case "podman":
+		reports, err := images.List(cr.ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		summaries := make([]imageSummary, len(reports))
+		for i, report := range reports {
+			summaries[i] = imageSummary{
+				ID:      report.ID,
+				Tags:    report.RepoTags,
+				Labels:  report.Labels,
+				Created: time.Unix(report.Created, 0),
+			}
+		}
+		return summaries, nil
+	case "docker":
+		return cr.docker.listImages()
+	default:
+		return nil, fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
+}
 
-	cmd.Args = append(cmd.Args, "--tty", "--interactive")
-	cmd.Args = append(cmd.Args, "--tmpfs", "/tmp:rw,exec,nodev,nosuid")
-	cmd.Args = append(cmd.Args, "--tmpfs", "/var/tmp:rw,exec,dev,suid")
+// containerSummary is a runtime-agnostic summary of a stored container,
+// just enough for prune to find and remove GC candidates.
+type containerSummary struct {
+	ID      string
+	Name    string
+	Created time.Time
+}
 
-	cmd.Args = append(cmd.Args, "--workdir", fmt.Sprintf("/mnt/products/%s/%s", s.Product.Short_name, s.Name))
+// listContainers lists every container (running or not) in local storage.
+func (cr *containerRuntime) listContainers() ([]containerSummary, error) {
+	switch cr.Kind {
+	case "podman":
+		all := true
+		reports, err := containers.List(cr.ctx, &containers.ListOptions{All: &all})
+		if err != nil {
+			return nil, err
+		}
+		summaries := make([]containerSummary, len(reports))
+		for i, report := range reports {
+			name := report.ID
+			if len(report.Names) > 0 {
+				name = report.Names[0]
+			}
+			summaries[i] = containerSummary{ID: report.ID, Name: name, Created: report.Created}
+		}
+		return summaries, nil
+	case "docker":
+		return cr.docker.listContainers()
+	default:
+		return nil, fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
+}
 
+// run creates, starts and streams stdio for the container that performs
+// 'action', waits for it to exit and returns its exit status as an error.
+func (cr *containerRuntime) run(image string, command []string, action string, s *sdk, r *recipe) error {
 	var recipeName string
 	if r != nil {
 		recipeName = r.Name
@@ -149,26 +434,77 @@ func (cr *containerRuntime) run(image string, command []string, action string, s
 		recipeName = s.Name
 	}
 
-	cmd.Args = append(cmd.Args, "--name", fmt.Sprintf("%s_%s.%s.working", s.Product.Short_name, recipeName, action))
-	cmd.Args = append(cmd.Args, "--hostname", fmt.Sprintf("%s-%s", s.Product.Short_name, recipeName))
-
-	cmd.Args = append(cmd.Args, "--env", fmt.Sprintf("COSMK_ACTION=%s", action))
-	cmd.Args = append(cmd.Args, "--env", fmt.Sprintf("COSMK_RECIPE=%s", recipeName))
-
+	env := map[string]string{
+		"COSMK_ACTION": action,
+		"COSMK_RECIPE": recipeName,
+	}
 	// Ignore instrumentation features during SDK bootstrap to avoid hardcoding them in the image.
 	if action != "bootstrap" {
-		cmd.Args = append(cmd.Args, rootConfig.env()...)
+		mergeEnv(env, rootConfig.env())
 	}
-	cmd.Args = append(cmd.Args, s.Product.env()...)
-	cmd.Args = append(cmd.Args, s.env()...)
+	mergeEnv(env, s.Product.env())
+	mergeEnv(env, s.env())
 	if r != nil {
-		cmd.Args = append(cmd.Args, r.env()...)
+		mergeEnv(env, r.env())
+	}
+
+	mounts, capAdd, network := cr.buildEnvironment(s, r, action)
+
+	spec := &containerSpec{
+		Image:    image,
+		Command:  command,
+		Name:     fmt.Sprintf("%s_%s.%s.working", s.Product.Short_name, recipeName, action),
+		Hostname: fmt.Sprintf("%s-%s", s.Product.Short_name, recipeName),
+		Workdir:  fmt.Sprintf("/mnt/products/%s/%s", s.Product.Short_name, s.Name),
+		Env:      env,
+		Mounts:   mounts,
+		CapAdd:   capAdd,
+		Network:  network,
+		// Keep the resulting container image only for the 'bootstrap' action
+		Remove:       action != "bootstrap",
+		DisableLabel: true,
+		Interactive:  true,
+	}
+
+	var err error
+	switch cr.Kind {
+	case "podman":
+		err = cr.runPodman(spec)
+	case "docker":
+		err = cr.docker.run(spec)
+	default:
+		err = fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
+	if err != nil {
+		Error.Printf("SDK exited with error code: %s", err)
+	}
+	return err
+}
+
+// buildEnvironment assembles the mounts, added capabilities and network
+// setting that action against s (optionally scoped to recipe r) needs: the
+// repo bind, '/tmp'-'/var/tmp' tmpfs, the 'out'/'cache' binds, and, for
+// 'bootstrap'/'build' actions, the writable-asset and binpkgs binds plus
+// s.Build.Capabilities. Shared by the interactive 'run' path and the
+// non-interactive build-step path so both grant the action the same
+// environment.
+func (cr *containerRuntime) buildEnvironment(s *sdk, r *recipe, action string) ([]mountSpec, []string, bool) {
+	var recipeName string
+	if r != nil {
+		recipeName = r.Name
+	} else {
+		recipeName = s.Name
+	}
+
+	mounts := []mountSpec{
+		{Source: "/tmp", Dest: "/tmp", Kind: "tmpfs", Options: "rw,exec,nodev,nosuid"},
+		{Source: "/var/tmp", Dest: "/var/tmp", Kind: "tmpfs", Options: "rw,exec,dev,suid"},
 	}
 
 	if action == "run" {
-		cmd.Args = append(cmd.Args, "--volume", fmt.Sprintf("%s:/mnt:rw", repoRootPath))
+		mounts = append(mounts, mountSpec{Source: repoRootPath, Dest: "/mnt", Kind: "bind", Options: "rw"})
 	} else {
-		cmd.Args = append(cmd.Args, "--volume", fmt.Sprintf("%s:/mnt:ro", repoRootPath))
+		mounts = append(mounts, mountSpec{Source: repoRootPath, Dest: "/mnt", Kind: "bind", Options: "ro"})
 	}
 
 	// Mount 'out' and 'cache' folder read-write
@@ -180,48 +516,236 @@ func (cr *containerRuntime) run(image string, command []string, action string, s
 			os.RemoveAll(pathHost)
 		}
 		os.MkdirAll(pathHost, 0755)
-		cmd.Args = append(cmd.Args, "--volume", fmt.Sprintf("%s:%s:rw", pathHost, pathSdk))
+		mounts = append(mounts, mountSpec{Source: pathHost, Dest: pathSdk, Kind: "bind", Options: "rw"})
 	}
 
+	var capAdd []string
+
 	// Additional capabilities and writable directory for 'build' & 'bootstrap' actions
 	if action == "bootstrap" || action == "build" {
 		for _, dir := range s.Build.Writable_assets {
 			distfilesHost := path.Join(repoRootPath, "assets", dir)
 			distfilesSdk := path.Join("/mnt", "assets", dir)
-			cmd.Args = append(cmd.Args, "--volume", fmt.Sprintf("%s:%s:rw", distfilesHost, distfilesSdk))
+			mounts = append(mounts, mountSpec{Source: distfilesHost, Dest: distfilesSdk, Kind: "bind", Options: "rw"})
 		}
 
 		binpkgHost := path.Join(repoRootPath, "cache", s.Product.Short_name, s.Product.Version, recipeName, "binpkgs")
 		binpkgSdk := path.Join("/mnt", "cache", s.Product.Short_name, s.Product.Version, recipeName, "binpkgs")
 		os.MkdirAll(binpkgHost, 0755)
-		cmd.Args = append(cmd.Args, "--volume", fmt.Sprintf("%s:%s:rw", binpkgHost, binpkgSdk))
+		mounts = append(mounts, mountSpec{Source: binpkgHost, Dest: binpkgSdk, Kind: "bind", Options: "rw"})
 
-		for _, v := range s.Build.Capabilities {
-			cmd.Args = append(cmd.Args, "--cap-add", v)
-		}
+		capAdd = append(capAdd, s.Build.Capabilities...)
 	}
 
 	// Network access is disabled by default. It can be re-enabled during
 	// development for 'bootstrap', 'build' and 'run' actions.
+	network := true
 	if rootConfig.Development.Network != "yes" {
-		cmd.Args = append(cmd.Args, "--network=none")
+		network = false
 	} else if !(action == "bootstrap" || action == "build" || action == "run") {
-		cmd.Args = append(cmd.Args, "--network=none")
+		network = false
 	}
 
-	// Keep the resulting container image only for the 'bootstrap' action
-	if action != "bootstrap" {
-		cmd.Args = append(cmd.Args, "--rm")
+	return mounts, capAdd, network
+}
+
+// runBuildStep runs a single non-interactive build instruction inside a
+// container created from parentImage, without removing the container
+// afterwards so the caller (the sdk or recipe builder) can commit it as a
+// new layer. env and workdir carry forward any 'env'/'workdir' instructions
+// seen earlier in the same build. action ("bootstrap" for an SDK step,
+// "build" for a recipe step) and s/r grant the step the same repo bind,
+// tmpfs, binpkgs/writable_assets mounts, capabilities and network access as
+// the 'bootstrap'/'build' actions it replaces, since a step may emerge,
+// patch or read repo files just as they did.
+func (cr *containerRuntime) runBuildStep(parentImage string, command []string, name string, env map[string]string, workdir string, s *sdk, r *recipe, action string) error {
+	mounts, capAdd, network := cr.buildEnvironment(s, r, action)
+
+	spec := &containerSpec{
+		Image:       parentImage,
+		Command:     command,
+		Name:        name,
+		Workdir:     workdir,
+		Env:         env,
+		Mounts:      mounts,
+		CapAdd:      capAdd,
+		Network:     network,
+		Remove:      false,
+		Interactive: false,
 	}
 
-	cmd.Args = append(cmd.Args, image)
-	cmd.Args = append(cmd.Args, command...)
+	switch cr.Kind {
+	case "podman":
+		return cr.runPodman(spec)
+	case "docker":
+		return cr.docker.run(spec)
+	default:
+		return fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
+}
 
-	Debug.Printf("Will run: %s", cmd.Args)
+// createWorkingContainer creates (but does not start) a container from
+// parentImage, for instructions like 'copy' that only need a filesystem to
+// write into before being committed as a new layer.
+func (cr *containerRuntime) createWorkingContainer(parentImage string, name string) error {
+	switch cr.Kind {
+	case "podman":
+		g := specgen.NewSpecGenerator(parentImage, false)
+		g.Name = name
+		_, err := containers.CreateWithSpec(cr.ctx, g, nil)
+		return err
+	case "docker":
+		return cr.docker.createContainer(parentImage, name)
+	default:
+		return fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
+}
 
-	err := cmd.Run()
+// copyToContainer copies hostPath (a file or directory) into the working
+// container 'name' at dstPath, archiving it as a tar stream the way 'podman
+// cp'/'docker cp' do.
+func (cr *containerRuntime) copyToContainer(name string, hostPath string, dstPath string) error {
+	archive, destDir, err := tarForCopy(hostPath, dstPath)
 	if err != nil {
-		Error.Printf("SDK exited with error code: %s", err)
+		return err
+	}
+
+	switch cr.Kind {
+	case "podman":
+		copyFunc, err := containers.CopyFromArchive(cr.ctx, name, destDir, archive)
+		if err != nil {
+			return err
+		}
+		return copyFunc()
+	case "docker":
+		return cr.docker.copyToContainer(name, destDir, archive)
+	default:
+		return fmt.Errorf("unsupported runtime kind '%s'", cr.Kind)
+	}
+}
+
+// mergeEnv flattens the "--env K=V" pairs produced by the *.env() helpers
+// back into a map, since the bindings API takes structured environment maps
+// rather than a CLI argument vector.
+func mergeEnv(dst map[string]string, pairs []string) {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i] != "--env" {
+			continue
+		}
+		kv := strings.SplitN(pairs[i+1], "=", 2)
+		if len(kv) == 2 {
+			dst[kv[0]] = kv[1]
+		}
+	}
+}
+
+// mountSpec is a runtime-agnostic description of a bind or tmpfs mount,
+// translated into the podman specgen.SpecGenerator (or Docker host config)
+// mounts by the respective backend.
+type mountSpec struct {
+	Source  string
+	Dest    string
+	Kind    string // "bind" or "tmpfs"
+	Options string
+}
+
+// containerSpec is a runtime-agnostic description of the container to run,
+// shared by the podman and docker backends.
+type containerSpec struct {
+	Image        string
+	Command      []string
+	Name         string
+	Hostname     string
+	Workdir      string
+	Env          map[string]string
+	Mounts       []mountSpec
+	CapAdd       []string
+	Network      bool
+	Remove       bool
+	DisableLabel bool
+	Interactive  bool
+}
+
+// runPodman creates, attaches, starts and waits for the container described
+// by spec using the podman bindings API.
+func (cr *containerRuntime) runPodman(spec *containerSpec) error {
+	g := specgen.NewSpecGenerator(spec.Image, false)
+	g.Name = spec.Name
+	g.Hostname = spec.Hostname
+	g.WorkDir = spec.Workdir
+	g.Command = spec.Command
+	g.Env = spec.Env
+	g.Terminal = spec.Interactive
+	g.Stdin = spec.Interactive
+	g.CapAdd = spec.CapAdd
+	g.Remove = spec.Remove
+
+	if spec.DisableLabel {
+		// Disable SELinux confinement to enable access to home directory content.
+		g.SelinuxOpts = append(g.SelinuxOpts, "disable")
+	}
+
+	if !spec.Network {
+		g.NetNS = specgen.Namespace{NSMode: specgen.NoNetwork}
+	}
+
+	for _, m := range spec.Mounts {
+		g.Mounts = append(g.Mounts, specMount(m))
+	}
+
+	createResp, err := containers.CreateWithSpec(cr.ctx, g, nil)
+	if err != nil {
+		return fmt.Errorf("could not create container '%s': %s", spec.Name, err)
+	}
+
+	if spec.Interactive {
+		attached := make(chan bool)
+		go func() {
+			err := containers.Attach(cr.ctx, createResp.ID, os.Stdin, os.Stdout, os.Stderr, attached, nil)
+			if err != nil {
+				Debug.Printf("Attach to container '%s' ended with: %s", spec.Name, err)
+			}
+		}()
+		<-attached
+	} else {
+		go containers.Logs(cr.ctx, createResp.ID, &containers.LogOptions{Follow: boolPtr(true), Stdout: boolPtr(true), Stderr: boolPtr(true)}, os.Stdout, os.Stderr)
+	}
+
+	err = containers.Start(cr.ctx, createResp.ID, nil)
+	if err != nil {
+		return fmt.Errorf("could not start container '%s': %s", spec.Name, err)
+	}
+
+	exitCode, err := containers.Wait(cr.ctx, createResp.ID, nil)
+	if err != nil {
+		return fmt.Errorf("could not wait for container '%s': %s", spec.Name, err)
+	}
+	emitEvent("exec-exit", map[string]interface{}{"container": spec.Name, "exit_code": exitCode})
+	if exitCode != 0 {
+		return fmt.Errorf("container '%s' exited with code %d", spec.Name, exitCode)
+	}
+	return nil
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func specMount(m mountSpec) specgen.Mount {
+	switch m.Kind {
+	case "tmpfs":
+		return specgen.Mount{
+			Destination: m.Dest,
+			Type:        define.TypeTmpfs,
+			Source:      "tmpfs",
+			Options:     strings.Split(m.Options, ","),
+		}
+	default:
+		return specgen.Mount{
+			Destination: m.Dest,
+			Type:        define.TypeBind,
+			Source:      m.Source,
+			Options:     strings.Split(m.Options, ","),
+		}
 	}
-	return err
 }
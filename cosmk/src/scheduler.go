@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// schedulerNode is a single recipe's unit of work in the build DAG.
+type schedulerNode struct {
+	Name      string
+	DependsOn []string
+	Task      func() error
+}
+
+func newSchedulerNode(name string, dependsOn []string, task func() error) *schedulerNode {
+	return &schedulerNode{Name: name, DependsOn: dependsOn, Task: task}
+}
+
+// checkDependencyGraph verifies that every 'depends_on' entry points at a
+// recipe that is actually part of this run and that the graph they form is
+// acyclic, using the classic white/gray/black DFS coloring.
+func checkDependencyGraph(nodes map[string]*schedulerNode) error {
+	const (
+		white = iota
+		gray
+		black
+	)
+	color := make(map[string]int, len(nodes))
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch color[name] {
+		case black:
+			return nil
+		case gray:
+			return fmt.Errorf("dependency cycle detected: %s -> %s", strings.Join(path, " -> "), name)
+		}
+
+		color[name] = gray
+		for _, dep := range nodes[name].DependsOn {
+			if _, ok := nodes[dep]; !ok {
+				return fmt.Errorf("recipe '%s' depends on unknown recipe '%s'", name, dep)
+			}
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		color[name] = black
+		return nil
+	}
+
+	for name := range nodes {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runScheduler builds a dependency graph over recipeNames (edges taken from
+// each recipe's 'depends_on' in recipe.toml), and runs 'task' for each
+// recipe, running recipes with no outstanding dependency concurrently up to
+// 'jobs' at a time. As soon as one recipe's task returns an error, recipes
+// that have not yet started are skipped and runScheduler returns that error
+// once every already-started recipe has finished.
+//
+// All dispatch decisions (which recipe to start next, which to skip) are
+// made in this single loop rather than raced between per-recipe goroutines,
+// so that among recipes with no outstanding dependency on one another the
+// one listed first in recipeNames always starts first. This preserves the
+// strict listed-order guarantee the pre-scheduler serial 'product.do' gave
+// for the common case of recipe.toml files with no 'depends_on' yet, instead
+// of leaving the tiebreak to goroutine-scheduling or map-iteration order.
+func runScheduler(recipeNames []string, jobs int, task func(name string) error) error {
+	nodes := make(map[string]*schedulerNode, len(recipeNames))
+	for _, name := range recipeNames {
+		name := name
+		r := parseRecipeConfig(name)
+		nodes[name] = newSchedulerNode(name, r.Depends_on, func() error { return task(name) })
+	}
+
+	if err := checkDependencyGraph(nodes); err != nil {
+		return err
+	}
+
+	if jobs <= 0 {
+		jobs = 1
+	}
+
+	indexOf := make(map[string]int, len(recipeNames))
+	dependents := make(map[string][]string, len(nodes))
+	remaining := make(map[string]int, len(nodes))
+	for i, name := range recipeNames {
+		indexOf[name] = i
+		remaining[name] = len(nodes[name].DependsOn)
+		for _, dep := range nodes[name].DependsOn {
+			dependents[dep] = append(dependents[dep], name)
+		}
+	}
+
+	var ready []string
+	for _, name := range recipeNames {
+		if remaining[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+
+	// popReady removes and returns the ready recipe listed earliest in
+	// recipeNames.
+	popReady := func() string {
+		best := 0
+		for i := 1; i < len(ready); i++ {
+			if indexOf[ready[i]] < indexOf[ready[best]] {
+				best = i
+			}
+		}
+		name := ready[best]
+		ready = append(ready[:best], ready[best+1:]...)
+		return name
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+	resultCh := make(chan result)
+
+	errs := make(map[string]error, len(nodes))
+	inFlight := 0
+	finished := 0
+	var firstErr error
+	failed := false
+
+	// finish records name's outcome and, for each recipe depending on it
+	// whose last outstanding dependency this was, either propagates the
+	// failure (if any of its dependencies failed) or marks it ready to run.
+	var finish func(name string, err error)
+	finish = func(name string, err error) {
+		errs[name] = err
+		finished++
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		for _, dependent := range dependents[name] {
+			remaining[dependent]--
+			if remaining[dependent] > 0 {
+				continue
+			}
+
+			var depErr error
+			for _, dep := range nodes[dependent].DependsOn {
+				if e := errs[dep]; e != nil {
+					depErr = fmt.Errorf("dependency '%s' failed: %s", dep, e)
+					break
+				}
+			}
+			if depErr != nil {
+				finish(dependent, depErr)
+			} else {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	for finished < len(nodes) {
+		if failed {
+			for len(ready) > 0 {
+				finish(popReady(), fmt.Errorf("skipped after an earlier recipe failed"))
+			}
+			if finished >= len(nodes) {
+				break
+			}
+		} else {
+			for inFlight < jobs && len(ready) > 0 {
+				name := popReady()
+				inFlight++
+				Info.Printf("Starting recipe '%s'", name)
+				go func(n *schedulerNode) {
+					resultCh <- result{n.Name, n.Task()}
+				}(nodes[name])
+			}
+		}
+
+		r := <-resultCh
+		inFlight--
+		if r.err != nil {
+			Error.Printf("Recipe '%s' failed: %s", r.name, r.err)
+			failed = true
+		} else {
+			Info.Printf("Finished recipe '%s'", r.name)
+		}
+		finish(r.name, r.err)
+	}
+
+	return firstErr
+}
@@ -6,10 +6,18 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 
 	"github.com/BurntSushi/toml"
 )
 
+// bootstrapLocks serializes bootstrap() per (product, SDK name): recipes
+// that share an SDK (the norm in a product) run concurrently under
+// 'cosmk all -j'>1, and without this they'd collide on the fixed working
+// container name and race the commit of the same SDK image. Keyed without
+// the tag since the working container name doesn't include it either.
+var bootstrapLocks sync.Map
+
 type sdkToml struct {
 	Tag         string
 	Bootstrap   sdkBootstrap
@@ -18,8 +26,9 @@ type sdkToml struct {
 }
 
 type sdkBootstrap struct {
-	Rootfs string
-	Steps  []string
+	Rootfs   string
+	Steps    []string
+	No_cache bool
 }
 
 type sdkBuild struct {
@@ -75,76 +84,151 @@ func (s *sdk) env() []string {
 }
 
 func (s *sdk) bootstrap() error {
-	imageName := fmt.Sprintf("%s/%s", rootConfig.Product.Name, s.Name)
-	Debug.Printf("Bootstrapping '%s:%s'", imageName, s.Tag)
+	lockKey := fmt.Sprintf("%s/%s", s.Product.Short_name, s.Name)
+	lockIface, _ := bootstrapLocks.LoadOrStore(lockKey, &sync.Mutex{})
+	lock := lockIface.(*sync.Mutex)
+	lock.Lock()
+	defer lock.Unlock()
+
+	ref := newImageRef(s.Name, s.Tag)
+	imageName := ref.Repository()
+	Debug.Printf("Bootstrapping '%s'", ref.RepositoryTag())
 
 	if rootConfig.Ci.Registry != "" {
 		err := runtime.findCiImage(imageName, s.Tag)
 		if err == nil {
-			Debug.Printf("No need to bootstrap '%s:%s'", imageName, s.Tag)
+			Debug.Printf("No need to bootstrap '%s'", ref.RepositoryTag())
 			return nil
 		}
 	}
 
 	err := runtime.findLocalImage(imageName, s.Tag)
 	if err == nil {
-		Debug.Printf("No need to bootstrap '%s:%s'", imageName, s.Tag)
+		Debug.Printf("No need to bootstrap '%s'", ref.RepositoryTag())
 		return nil
 	}
 
-	Info.Printf("No image found. Bootstrapping image '%s:%s' from scratch", imageName, s.Tag)
+	Info.Printf("No image found. Bootstrapping image '%s' from scratch", ref.RepositoryTag())
 
-	bootstrapVersion := fmt.Sprintf("%s.bootstrap", s.Tag)
-	err = runtime.findLocalImage(imageName, bootstrapVersion)
+	bootstrapRef := newImageRef(s.Name, fmt.Sprintf("%s.bootstrap", s.Tag))
+	err = runtime.findLocalImage(imageName, bootstrapRef.Tag)
 	if err != nil {
 		rootfs := path.Join(repoRootPath, s.Bootstrap.Rootfs)
 		Info.Printf("Importing rootfs from '%s'", s.Bootstrap.Rootfs)
-		cmd := runtime.command()
-		cmd.Args = append(cmd.Args, "import", rootfs, fmt.Sprintf("localhost/%s:%s", imageName, bootstrapVersion))
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+		err = runtime.importRootfs(rootfs, bootstrapRef.Local())
 		if err != nil {
 			Error.Fatalf("Could not import rootfs from '%s': %s", rootfs, err)
 		}
 	}
 
+	baseImage := bootstrapRef.Local()
+
+	// Recipes that declare 'Steps' in their [bootstrap] section go through
+	// the step-by-step builder, which commits one intermediate layer per
+	// step instead of a single opaque 'bootstrap.sh' run.
+	if len(s.Bootstrap.Steps) > 0 {
+		b := newSdkBuilder(s)
+		lastStep, err := b.build(baseImage)
+		if err != nil {
+			return err
+		}
+
+		Info.Printf("Tagging final image '%s'", ref.RepositoryTag())
+		err = runtime.tag(lastStep, ref.RepositoryTag())
+		if err != nil {
+			Error.Fatalf("Could not tag final SDK image: %s", err)
+		}
+		Info.Printf("Successfully tagged final image '%s'", ref.RepositoryTag())
+		return s.publishIfRequested()
+	}
+
 	workContainer := fmt.Sprintf("%s_%s.%s.working", s.Product.Short_name, s.Name, "bootstrap")
+
+	// Best-effort: if anything panics between here and the commit below, make
+	// sure the working container doesn't leak. 'cosmk prune' also catches
+	// containers an unclean process exit (e.g. Ctrl-C) leaves behind.
+	defer func() {
+		if r := recover(); r != nil {
+			runtime.removeContainer(workContainer)
+			panic(r)
+		}
+	}()
+
 	Debug.Printf("Removing temporary container '%s'", workContainer)
-	cmd := runtime.command()
-	cmd.Args = append(cmd.Args, "rm", workContainer)
-	err = cmd.Run()
+	err = runtime.removeContainer(workContainer)
 	if err != nil {
 		Debug.Printf("Could not remove temporary container '%s': %s", workContainer, err)
 	}
 	Debug.Printf("Removed temporary container '%s'", workContainer)
 
-	Info.Printf("Running bootstrap step for '%s'", fmt.Sprintf("%s:%s", imageName, bootstrapVersion))
-	err = runtime.run(fmt.Sprintf("localhost/%s:%s", imageName, bootstrapVersion), []string{"./bootstrap.sh"}, "bootstrap", s, nil)
+	Info.Printf("Running bootstrap step for '%s'", baseImage)
+	err = runtime.run(baseImage, []string{"./bootstrap.sh"}, "bootstrap", s, nil)
 	if err != nil {
 		return err
 	}
 
-	Info.Printf("Commiting final image '%s:%s'", imageName, s.Tag)
-	cmd = runtime.command()
-	cmd.Args = append(cmd.Args, "commit", workContainer, fmt.Sprintf("%s:%s", imageName, s.Tag))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	Info.Printf("Commiting final image '%s'", ref.RepositoryTag())
+	err = runtime.commit(workContainer, ref.RepositoryTag())
 	if err != nil {
 		Error.Fatalf("Could not commit final SDK image: %s", err)
 	}
-	Info.Printf("Sucessfully commited final image '%s:%s '", imageName, s.Tag)
+	Info.Printf("Sucessfully commited final image '%s'", ref.RepositoryTag())
 
 	Info.Printf("Removing temporary container '%s'", workContainer)
-	cmd = runtime.command()
-	cmd.Args = append(cmd.Args, "rm", workContainer)
-	err = cmd.Run()
+	err = runtime.removeContainer(workContainer)
 	if err != nil {
 		Error.Fatalf("Could not remove temporary container '%s': %s", workContainer, err)
 	}
 	Info.Printf("Removed temporary container '%s'", workContainer)
 
+	return s.publishIfRequested()
+}
+
+// publishIfRequested pushes the freshly built SDK image (and its
+// '.bootstrap' base) to rootConfig.Ci.Registry when the '--publish' flag or
+// the COSMK_PUBLISH=1 environment variable is set.
+func (s *sdk) publishIfRequested() error {
+	if !*publish && os.Getenv("COSMK_PUBLISH") != "1" {
+		return nil
+	}
+	return s.push()
+}
+
+// pull fetches the SDK's final image from rootConfig.Ci.Registry into local
+// storage.
+func (s *sdk) pull() error {
+	ref := newImageRef(s.Name, s.Tag).Remote(rootConfig.Ci.Registry)
+	Info.Printf("Pulling '%s'", ref)
+	return runtime.pull(ref)
+}
+
+// push publishes the SDK's final image and its '.bootstrap' base to
+// rootConfig.Ci.Registry, skipping whichever of the two isn't present in
+// local storage.
+func (s *sdk) push() error {
+	for _, tag := range []string{s.Tag, fmt.Sprintf("%s.bootstrap", s.Tag)} {
+		localRef := newImageRef(s.Name, tag)
+		local := localRef.RepositoryTag()
+		ref := localRef.Remote(rootConfig.Ci.Registry)
+
+		found, err := runtime.imageExists(local)
+		if err != nil || !found {
+			Debug.Printf("Skipping push of '%s': not present locally", local)
+			continue
+		}
+
+		err = runtime.tag(local, ref)
+		if err != nil {
+			return fmt.Errorf("could not tag '%s' as '%s': %s", local, ref, err)
+		}
+
+		Info.Printf("Pushing '%s'", ref)
+		err = runtime.push(ref)
+		if err != nil {
+			return fmt.Errorf("could not push '%s': %s", ref, err)
+		}
+	}
+
 	return nil
 }
 
@@ -153,6 +237,5 @@ func (s *sdk) run(command []string) error {
 	if err != nil {
 		return err
 	}
-	imageName := fmt.Sprintf("%s/%s", rootConfig.Product.Name, s.Name)
-	return runtime.run(fmt.Sprintf("%s:%s", imageName, s.Tag), command, "run", s, nil)
+	return runtime.run(newImageRef(s.Name, s.Tag).RepositoryTag(), command, "run", s, nil)
 }